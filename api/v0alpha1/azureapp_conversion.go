@@ -0,0 +1,118 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v0alpha1
+
+import (
+	"encoding/json"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	"sigs.k8s.io/controller-runtime/pkg/conversion"
+
+	"github.com/rdalbuquerque/azure-operator/operator/api/v1alpha1"
+)
+
+// SpecAnnotation keeps the v1alpha1 spec of an app read as v0alpha1 when it has fields v0alpha1 can't hold,
+// so converting it back to v1alpha1 doesn't lose them
+const SpecAnnotation = "azureapp.rda.dev/v1alpha1-spec"
+
+var _ conversion.Convertible = &AzureApp{}
+
+// ConvertTo converts this AzureApp to the Hub version (v1alpha1)
+func (src *AzureApp) ConvertTo(dstRaw conversion.Hub) error {
+	dst := dstRaw.(*v1alpha1.AzureApp)
+	dst.ObjectMeta = *src.ObjectMeta.DeepCopy()
+	if data, ok := dst.Annotations[SpecAnnotation]; ok {
+		if err := json.Unmarshal([]byte(data), &dst.Spec); err != nil {
+			return err
+		}
+		delete(dst.Annotations, SpecAnnotation)
+		if len(dst.Annotations) == 0 {
+			dst.Annotations = nil
+		}
+	}
+	// fields set on v0alpha1 always win over the kept spec, they may have been changed since
+	convertSpecTo(&src.Spec, &dst.Spec)
+	dst.Status = *src.Status.DeepCopy()
+	return nil
+}
+
+// ConvertFrom converts from the Hub version (v1alpha1) to this version
+func (dst *AzureApp) ConvertFrom(srcRaw conversion.Hub) error {
+	src := srcRaw.(*v1alpha1.AzureApp)
+	dst.ObjectMeta = *src.ObjectMeta.DeepCopy()
+	convertSpecFrom(&src.Spec, &dst.Spec)
+	dst.Status = *src.Status.DeepCopy()
+
+	var restored v1alpha1.AzureAppSpec
+	convertSpecTo(&dst.Spec, &restored)
+	if equality.Semantic.DeepEqual(restored, src.Spec) {
+		return nil
+	}
+	data, err := json.Marshal(src.Spec)
+	if err != nil {
+		return err
+	}
+	if dst.Annotations == nil {
+		dst.Annotations = map[string]string{}
+	}
+	dst.Annotations[SpecAnnotation] = string(data)
+	return nil
+}
+
+func convertSpecTo(src *AzureAppSpec, dst *v1alpha1.AzureAppSpec) {
+	dst.Identifier = src.Identifier
+	dst.AzureAD.IdentifierURI = src.IdentifierURI
+	dst.AzureAD.AppRoles = src.AppRoles
+	dst.Workload.Image = src.ContainerImage
+	dst.Workload.Replicas = src.Replicas
+	dst.Workload.EnvVars = src.EnvVars
+	dst.Networking.Url = src.Url
+	dst.Networking.ServingPort = src.ServingPort
+	dst.Database.Enabled = src.EnableDatabase
+	dst.DriftDetection = nil
+	if src.DriftDetection != nil {
+		dst.DriftDetection = &v1alpha1.DriftDetection{
+			Interval: src.DriftDetection.Interval,
+			Mode:     v1alpha1.DriftDetectionMode(src.DriftDetection.Mode),
+		}
+	}
+	dst.Approval = v1alpha1.ApprovalPolicy(src.Approval)
+	dst.DeletionPolicy = v1alpha1.DeletionPolicy(src.DeletionPolicy)
+	dst.Suspend = src.Suspend
+}
+
+func convertSpecFrom(src *v1alpha1.AzureAppSpec, dst *AzureAppSpec) {
+	dst.Identifier = src.Identifier
+	dst.IdentifierURI = src.AzureAD.IdentifierURI
+	dst.AppRoles = src.AzureAD.AppRoles
+	dst.ContainerImage = src.Workload.Image
+	dst.Replicas = src.Workload.Replicas
+	dst.EnvVars = src.Workload.EnvVars
+	dst.Url = src.Networking.Url
+	dst.ServingPort = src.Networking.ServingPort
+	dst.EnableDatabase = src.Database.Enabled
+	dst.DriftDetection = nil
+	if src.DriftDetection != nil {
+		dst.DriftDetection = &DriftDetection{
+			Interval: src.DriftDetection.Interval,
+			Mode:     DriftDetectionMode(src.DriftDetection.Mode),
+		}
+	}
+	dst.Approval = ApprovalPolicy(src.Approval)
+	dst.DeletionPolicy = DeletionPolicy(src.DeletionPolicy)
+	dst.Suspend = src.Suspend
+}
@@ -0,0 +1,155 @@
+package v0alpha1
+
+import (
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/rdalbuquerque/azure-operator/operator/api/v1alpha1"
+)
+
+func TestConvertRoundTripFromSpoke(t *testing.T) {
+	replicas := int32(2)
+	planTime := metav1.NewTime(time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC))
+	src := &AzureApp{
+		ObjectMeta: metav1.ObjectMeta{Name: "app1", Namespace: "default", Annotations: map[string]string{v1alpha1.ApprovedPlanAnnotation: "abc"}},
+		Spec: AzureAppSpec{
+			Url:            "myapp.local.dev",
+			IdentifierURI:  "api://appuri1",
+			Identifier:     "apprda001",
+			ServingPort:    8080,
+			ContainerImage: "nginx",
+			Replicas:       &replicas,
+			AppRoles:       []string{"role1", "role2"},
+			EnvVars:        map[string]string{"var1": "value1"},
+			EnableDatabase: true,
+			DriftDetection: &DriftDetection{Interval: &metav1.Duration{Duration: time.Hour}, Mode: DriftReport},
+			Approval:       ApprovalManualOnDestroy,
+			DeletionPolicy: DeletionOrphan,
+			Suspend:        true,
+		},
+		Status: v1alpha1.AzureAppStatus{
+			Deployment:         "apprda001",
+			ProvisioningState:  "Provisioned",
+			SpecHash:           "hash",
+			LastAppliedTime:    &planTime,
+			LastPlanTime:       &planTime,
+			LastPlan:           &v1alpha1.PlanSummary{Add: 1, Resources: []v1alpha1.PlannedResource{{Address: "azurerm_key_vault.this", Action: "create"}}, Hash: "abc", InputsHash: "inputs", Time: planTime},
+			Certificate:        &v1alpha1.CertificateStatus{Version: "v1", NotAfter: &planTime},
+			Database:           &v1alpha1.DatabaseStatus{User: "apprda001-app", Roles: []string{"db_datareader"}, SchemaPermissions: []string{"EXECUTE ON SCHEMA::sales"}},
+			KeyVaultSecrets:    []v1alpha1.KeyVaultSecretStatus{{Name: "db-connection", Version: "0123456789abcdef"}},
+			Migration:          &v1alpha1.MigrationStatus{Job: "apprda001-migrate-0123456789", Image: "migrate:v1", CompletionTime: &planTime},
+			ObservedGeneration: 3,
+			Conditions:         []metav1.Condition{{Type: v1alpha1.ConditionReady, Status: metav1.ConditionTrue, Reason: "Provisioned", LastTransitionTime: planTime}},
+		},
+	}
+
+	hub := &v1alpha1.AzureApp{}
+	if err := src.ConvertTo(hub); err != nil {
+		t.Fatal(err)
+	}
+	if hub.Spec.Workload.Image != "nginx" || hub.Spec.AzureAD.IdentifierURI != "api://appuri1" || !hub.Spec.Database.Enabled || hub.Spec.Networking.ServingPort != 8080 {
+		t.Errorf("unexpected hub spec %+v", hub.Spec)
+	}
+	dst := &AzureApp{}
+	if err := dst.ConvertFrom(hub); err != nil {
+		t.Fatal(err)
+	}
+	if !equality.Semantic.DeepEqual(src, dst) {
+		t.Errorf("round trip changed the app\nwant %+v\ngot  %+v", src, dst)
+	}
+}
+
+func TestConvertRoundTripFromHub(t *testing.T) {
+	replicas := int32(0)
+	src := &v1alpha1.AzureApp{
+		ObjectMeta: metav1.ObjectMeta{Name: "app1", Namespace: "default"},
+		Spec: v1alpha1.AzureAppSpec{
+			Identifier: "apprda001",
+			AzureAD:    v1alpha1.AzureADSpec{IdentifierURI: "api://appuri1", AppRoles: []string{"role1"}},
+			Workload:   v1alpha1.WorkloadSpec{Image: "nginx", Replicas: &replicas, EnvVars: map[string]string{"var1": "value1"}},
+			Networking: v1alpha1.NetworkingSpec{Url: "myapp.local.dev", ServingPort: 8080},
+			Database:   v1alpha1.DatabaseSpec{Enabled: true},
+			Approval:   v1alpha1.ApprovalManual,
+		},
+		Status: v1alpha1.AzureAppStatus{ProvisioningState: "Awaiting approval", LastPlan: &v1alpha1.PlanSummary{Destroy: 1, Hash: "def"}},
+	}
+
+	spoke := &AzureApp{}
+	if err := spoke.ConvertFrom(src); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := spoke.Annotations[SpecAnnotation]; ok {
+		t.Error("spec representable in v0alpha1 was kept in an annotation")
+	}
+	dst := &v1alpha1.AzureApp{}
+	if err := spoke.ConvertTo(dst); err != nil {
+		t.Fatal(err)
+	}
+	if !equality.Semantic.DeepEqual(src, dst) {
+		t.Errorf("round trip changed the app\nwant %+v\ngot  %+v", src, dst)
+	}
+}
+
+func TestConvertRoundTripKeepsHubOnlyFields(t *testing.T) {
+	validity := int32(6)
+	src := &v1alpha1.AzureApp{
+		ObjectMeta: metav1.ObjectMeta{Name: "app1", Namespace: "default"},
+		Spec: v1alpha1.AzureAppSpec{
+			Identifier: "apprda001",
+			Networking: v1alpha1.NetworkingSpec{Url: "myapp.local.dev", ServingPort: 8080},
+			TLS:        v1alpha1.TLSSpec{CertificateName: "web", Issuer: &v1alpha1.CertificateIssuer{Name: "digicert", ValidityInMonths: &validity}},
+			Database: v1alpha1.DatabaseSpec{
+				Enabled:      true,
+				Roles:        []string{"db_datareader", "db_datawriter"},
+				SchemaGrants: []v1alpha1.SchemaGrant{{Schema: "sales", Permissions: []v1alpha1.SchemaPermission{"EXECUTE"}}},
+				EnvVars:      v1alpha1.DatabaseEnvVars{Server: "SQL_HOST", Name: "SQL_DATABASE", ConnectionString: "SQLCONNSTR_app"},
+				Migrations:   &v1alpha1.DatabaseMigrations{Image: "migrate:v1", Command: []string{"migrate", "up"}},
+			},
+			KeyVaultSecrets: []v1alpha1.KeyVaultSecret{
+				{Name: "db-connection", EnvVar: "DB_CONNECTION"},
+				{Name: "api-key", FileKey: "api-key", Version: "0123456789abcdef"},
+			},
+		},
+	}
+
+	spoke := &AzureApp{}
+	if err := spoke.ConvertFrom(src); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := spoke.Annotations[SpecAnnotation]; !ok {
+		t.Fatal("spec.tls, spec.keyVaultSecrets and the database access, env vars and migrations can't be represented in v0alpha1 and must be kept in an annotation")
+	}
+	dst := &v1alpha1.AzureApp{}
+	if err := spoke.ConvertTo(dst); err != nil {
+		t.Fatal(err)
+	}
+	if !equality.Semantic.DeepEqual(src, dst) {
+		t.Errorf("round trip changed the app\nwant %+v\ngot  %+v", src, dst)
+	}
+}
+
+func TestConvertToRestoresKeptSpec(t *testing.T) {
+	// a spec kept by an earlier ConvertFrom is restored, but the v0alpha1 fields changed since then win
+	src := &AzureApp{
+		ObjectMeta: metav1.ObjectMeta{Name: "app1", Annotations: map[string]string{
+			SpecAnnotation: `{"identifier":"apprda001","workload":{"image":"nginx:old","replicas":5}}`,
+		}},
+		Spec: AzureAppSpec{Identifier: "apprda001", ContainerImage: "nginx:new"},
+	}
+	dst := &v1alpha1.AzureApp{}
+	if err := src.ConvertTo(dst); err != nil {
+		t.Fatal(err)
+	}
+	if dst.Spec.Workload.Image != "nginx:new" {
+		t.Errorf("expected the v0alpha1 image to win, got %s", dst.Spec.Workload.Image)
+	}
+	if dst.Annotations != nil {
+		t.Errorf("expected the kept spec annotation to be removed, got %v", dst.Annotations)
+	}
+	if _, ok := src.Annotations[SpecAnnotation]; !ok {
+		t.Error("conversion modified the source annotations")
+	}
+}
@@ -18,6 +18,8 @@ package v0alpha1
 
 import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/rdalbuquerque/azure-operator/operator/api/v1alpha1"
 )
 
 // EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
@@ -31,33 +33,92 @@ type AzureAppSpec struct {
 	// Url will be the primary url for your app, used both in Azure App IdentifierURI field and Ingress
 	Url string `json:"url,omitempty"`
 	// IdentifierURI will be used to set the identifierUri field on Azure app registration
+	//+kubebuilder:validation:Pattern=`^(api|https)://[^/]+`
 	IdentifierURI string `json:"identifierUri,omitempty"`
-	// Identifier will be used on app registration name on Azure and kubernetes resources
+	// Identifier will be used on app registration name on Azure and kubernetes resources, it can't be changed
+	// and is limited to 21 characters so the key vault name <identifier>-kv stays valid
+	//+kubebuilder:validation:MaxLength=21
+	//+kubebuilder:validation:Pattern=`^[a-z](-?[a-z0-9])*$`
 	Identifier string `json:"identifier,omitempty"`
 	// ServingPort will be used to set the port configuration on your service - the node port will still be random
+	//+kubebuilder:validation:Minimum=1
+	//+kubebuilder:validation:Maximum=65535
 	ServingPort int32 `json:"servingPort,omitempty"`
 	// ContainerImage will set the app's image
 	ContainerImage string `json:"containerImage,omitempty"`
+	// Replicas is the number of app pods, defaults to 1
+	//+kubebuilder:validation:Minimum=0
+	Replicas *int32 `json:"replicas,omitempty"`
 	// AppRoles will be used to set app registration roles on Azure
+	//+listType=set
 	AppRoles []string `json:"appRoles,omitempty"`
 	// EnvVars will set the app's environment variables
 	EnvVars map[string]string `json:"envVars,omitempty"`
 	// EnableDatabase will set if an Azure Sql Database should be created
 	EnableDatabase bool `json:"enableDatabase,omitempty"`
+	// DriftDetection configures how changes made to the app Azure resources outside the operator are handled
+	DriftDetection *DriftDetection `json:"driftDetection,omitempty"`
+	// Approval sets which terraform plans wait for a manual approval before being applied
+	//+kubebuilder:validation:Enum=auto;manual;manualOnDestroy
+	//+kubebuilder:default=auto
+	Approval ApprovalPolicy `json:"approval,omitempty"`
+	// DeletionPolicy sets what happens to the app Azure resources and terraform state when the AzureApp is deleted
+	//+kubebuilder:validation:Enum=Delete;Retain;Orphan
+	//+kubebuilder:default=Delete
+	DeletionPolicy DeletionPolicy `json:"deletionPolicy,omitempty"`
+	// Suspend stops reconciling the app, it's only reconciled again for deletion or once resumed
+	Suspend bool `json:"suspend,omitempty"`
 }
 
-// AzureAppStatus defines the observed state of AzureApp
-type AzureAppStatus struct {
-	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
-	// Important: Run "make" to regenerate code after modifying this file
-	Deployment        string `json:"deployment,omitempty"`
-	ProvisioningState string `json:"provisioningState,omitempty"`
+// DeletionPolicy defines what deleting an AzureApp does to its Azure resources
+type DeletionPolicy string
+
+const (
+	// DeletionDelete destroys the Azure resources and deletes the terraform state
+	DeletionDelete DeletionPolicy = "Delete"
+	// DeletionRetain keeps the Azure resources and the terraform state, an AzureApp with the same name adopts them again
+	DeletionRetain DeletionPolicy = "Retain"
+	// DeletionOrphan keeps the Azure resources and archives the terraform state under a tombstone key
+	DeletionOrphan DeletionPolicy = "Orphan"
+)
+
+// ApprovalPolicy defines which terraform plans need a manual approval
+type ApprovalPolicy string
+
+const (
+	// ApprovalAuto applies every plan
+	ApprovalAuto ApprovalPolicy = "auto"
+	// ApprovalManual waits for approval of every plan with changes
+	ApprovalManual ApprovalPolicy = "manual"
+	// ApprovalManualOnDestroy waits for approval of plans that destroy or replace resources
+	ApprovalManualOnDestroy ApprovalPolicy = "manualOnDestroy"
+)
+
+// DriftDetectionMode defines what the controller does once it detects drift
+type DriftDetectionMode string
+
+const (
+	// DriftRemediate applies the plan that reverts the drift
+	DriftRemediate DriftDetectionMode = "remediate"
+	// DriftReport only reports the drift on status and events
+	DriftReport DriftDetectionMode = "report"
+)
+
+// DriftDetection configures the periodic terraform plan of an unchanged spec
+type DriftDetection struct {
+	// Interval between drift detection plans, defaults to the resync period annotation or the operator DRIFT_DETECTION_INTERVAL
+	Interval *metav1.Duration `json:"interval,omitempty"`
+	// Mode is remediate, to apply the plan that reverts drift, or report, to only report it
+	//+kubebuilder:validation:Enum=remediate;report
+	//+kubebuilder:default=remediate
+	Mode DriftDetectionMode `json:"mode,omitempty"`
 }
 
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
 //+kubebuilder:printcolumn:JSONPath=".status.deployment",name="Deployment",type="string"
 //+kubebuilder:printcolumn:JSONPath=".status.provisioningState",name="ProvisioningState",type="string"
+//+kubebuilder:printcolumn:JSONPath=".status.conditions[?(@.type==\"Ready\")].status",name="Ready",type="string"
 //+kubebuilder:printcolumn:JSONPath=".metadata.creationTimestamp",name="Age",type="date"
 
 // AzureApp is the Schema for the azureapps API
@@ -65,8 +126,9 @@ type AzureApp struct {
 	metav1.TypeMeta   `json:",inline"`
 	metav1.ObjectMeta `json:"metadata,omitempty"`
 
-	Spec   AzureAppSpec   `json:"spec,omitempty"`
-	Status AzureAppStatus `json:"status,omitempty"`
+	Spec AzureAppSpec `json:"spec,omitempty"`
+	// Status is the status of the hub version, both versions report the same observed state
+	Status v1alpha1.AzureAppStatus `json:"status,omitempty"`
 }
 
 //+kubebuilder:object:root=true
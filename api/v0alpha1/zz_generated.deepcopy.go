@@ -22,6 +22,7 @@ limitations under the License.
 package v0alpha1
 
 import (
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
@@ -31,7 +32,7 @@ func (in *AzureApp) DeepCopyInto(out *AzureApp) {
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
 	in.Spec.DeepCopyInto(&out.Spec)
-	out.Status = in.Status
+	in.Status.DeepCopyInto(&out.Status)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AzureApp.
@@ -87,6 +88,11 @@ func (in *AzureAppList) DeepCopyObject() runtime.Object {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *AzureAppSpec) DeepCopyInto(out *AzureAppSpec) {
 	*out = *in
+	if in.Replicas != nil {
+		in, out := &in.Replicas, &out.Replicas
+		*out = new(int32)
+		**out = **in
+	}
 	if in.AppRoles != nil {
 		in, out := &in.AppRoles, &out.AppRoles
 		*out = make([]string, len(*in))
@@ -99,6 +105,11 @@ func (in *AzureAppSpec) DeepCopyInto(out *AzureAppSpec) {
 			(*out)[key] = val
 		}
 	}
+	if in.DriftDetection != nil {
+		in, out := &in.DriftDetection, &out.DriftDetection
+		*out = new(DriftDetection)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AzureAppSpec.
@@ -112,16 +123,21 @@ func (in *AzureAppSpec) DeepCopy() *AzureAppSpec {
 }
 
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
-func (in *AzureAppStatus) DeepCopyInto(out *AzureAppStatus) {
+func (in *DriftDetection) DeepCopyInto(out *DriftDetection) {
 	*out = *in
+	if in.Interval != nil {
+		in, out := &in.Interval, &out.Interval
+		*out = new(v1.Duration)
+		**out = **in
+	}
 }
 
-// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AzureAppStatus.
-func (in *AzureAppStatus) DeepCopy() *AzureAppStatus {
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DriftDetection.
+func (in *DriftDetection) DeepCopy() *DriftDetection {
 	if in == nil {
 		return nil
 	}
-	out := new(AzureAppStatus)
+	out := new(DriftDetection)
 	in.DeepCopyInto(out)
 	return out
 }
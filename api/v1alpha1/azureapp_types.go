@@ -0,0 +1,402 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// AzureAppSpec defines the desired state of AzureApp
+type AzureAppSpec struct {
+	// Identifier will be used on app registration name on Azure and kubernetes resources, it can't be changed
+	// and is limited to 21 characters so the key vault name <identifier>-kv stays valid
+	//+kubebuilder:validation:MaxLength=21
+	//+kubebuilder:validation:Pattern=`^[a-z](-?[a-z0-9])*$`
+	Identifier string `json:"identifier,omitempty"`
+	// AzureAD configures the app registration on Azure AD
+	AzureAD AzureADSpec `json:"azureAD,omitempty"`
+	// Workload configures the app deployment
+	Workload WorkloadSpec `json:"workload,omitempty"`
+	// KeyVaultSecrets projects secrets of the app key vault into the app pods as env vars or files
+	KeyVaultSecrets []KeyVaultSecret `json:"keyVaultSecrets,omitempty"`
+	// Networking configures how the app is exposed
+	Networking NetworkingSpec `json:"networking,omitempty"`
+	// TLS configures the certificate served by the app ingress
+	TLS TLSSpec `json:"tls,omitempty"`
+	// Database configures the app Azure Sql Database
+	Database DatabaseSpec `json:"database,omitempty"`
+	// DriftDetection configures how changes made to the app Azure resources outside the operator are handled
+	DriftDetection *DriftDetection `json:"driftDetection,omitempty"`
+	// Approval sets which terraform plans wait for a manual approval before being applied
+	//+kubebuilder:validation:Enum=auto;manual;manualOnDestroy
+	//+kubebuilder:default=auto
+	Approval ApprovalPolicy `json:"approval,omitempty"`
+	// DeletionPolicy sets what happens to the app Azure resources and terraform state when the AzureApp is deleted
+	//+kubebuilder:validation:Enum=Delete;Retain;Orphan
+	//+kubebuilder:default=Delete
+	DeletionPolicy DeletionPolicy `json:"deletionPolicy,omitempty"`
+	// Suspend stops reconciling the app, it's only reconciled again for deletion or once resumed
+	Suspend bool `json:"suspend,omitempty"`
+}
+
+// AzureADSpec configures the app registration on Azure AD
+type AzureADSpec struct {
+	// IdentifierURI will be used to set the identifierUri field on Azure app registration
+	//+kubebuilder:validation:Pattern=`^(api|https)://[^/]+`
+	IdentifierURI string `json:"identifierUri,omitempty"`
+	// AppRoles will be used to set app registration roles on Azure
+	//+listType=set
+	AppRoles []string `json:"appRoles,omitempty"`
+}
+
+// WorkloadSpec configures the app deployment
+type WorkloadSpec struct {
+	// Image will set the app's container image
+	Image string `json:"image,omitempty"`
+	// Replicas is the number of app pods, defaults to 1
+	//+kubebuilder:validation:Minimum=0
+	Replicas *int32 `json:"replicas,omitempty"`
+	// EnvVars will set the app's environment variables
+	EnvVars map[string]string `json:"envVars,omitempty"`
+}
+
+// KeyVaultSecretsMountPath is where the key vault secrets with a fileKey are mounted in the app container
+const KeyVaultSecretsMountPath = "/etc/azureapp/keyvault"
+
+// KeyVaultSecret is a secret of the app key vault projected into the app pods. Only one of envVar and fileKey
+// can be set.
+type KeyVaultSecret struct {
+	// Name of the secret in the app key vault
+	//+kubebuilder:validation:MaxLength=127
+	//+kubebuilder:validation:Pattern=`^[0-9a-zA-Z-]+$`
+	Name string `json:"name"`
+	// EnvVar is the app environment variable set to the secret value
+	EnvVar string `json:"envVar,omitempty"`
+	// FileKey is the name of the file holding the secret value, under /etc/azureapp/keyvault
+	//+kubebuilder:validation:Pattern=`^[-._a-zA-Z0-9]+$`
+	FileKey string `json:"fileKey,omitempty"`
+	// Version pins the secret version, the latest version is projected and kept up to date when it's empty
+	Version string `json:"version,omitempty"`
+}
+
+// NetworkingSpec configures how the app is exposed
+type NetworkingSpec struct {
+	// Url will be the primary url for your app, used as the Ingress host
+	Url string `json:"url,omitempty"`
+	// ServingPort will be used to set the port configuration on your service - the node port will still be random
+	//+kubebuilder:validation:Minimum=1
+	//+kubebuilder:validation:Maximum=65535
+	ServingPort int32 `json:"servingPort,omitempty"`
+}
+
+// TLSSpec configures the certificate served by the app ingress, by default the ingress waits for a certificate
+// uploaded to the app key vault. Only one of issuer, selfSigned and disabled can be set.
+type TLSSpec struct {
+	// CertificateName is the app key vault certificate served by the ingress, defaults to tls
+	//+kubebuilder:validation:MaxLength=127
+	//+kubebuilder:validation:Pattern=`^[0-9a-zA-Z-]+$`
+	CertificateName string `json:"certificateName,omitempty"`
+	// Issuer has the operator create the certificate from a Key Vault certificate issuer when it's missing
+	Issuer *CertificateIssuer `json:"issuer,omitempty"`
+	// SelfSigned has the operator create a self-signed certificate when it's missing, meant for dev namespaces
+	SelfSigned bool `json:"selfSigned,omitempty"`
+	// Disabled serves the ingress without tls, the app doesn't wait for a certificate
+	Disabled bool `json:"disabled,omitempty"`
+}
+
+// CertificateIssuer is the issuer policy of a certificate created by the operator
+type CertificateIssuer struct {
+	// Name of the certificate issuer registered in the app key vault
+	//+kubebuilder:validation:MinLength=1
+	Name string `json:"name"`
+	// CertificateType is the type of certificate requested from the issuer, like OV-SSL or EV-SSL
+	CertificateType string `json:"certificateType,omitempty"`
+	// ValidityInMonths of each certificate version, defaults to 12
+	//+kubebuilder:validation:Minimum=1
+	ValidityInMonths *int32 `json:"validityInMonths,omitempty"`
+}
+
+// DatabaseSpec configures the app Azure Sql Database
+type DatabaseSpec struct {
+	// Enabled will set if an Azure Sql Database should be created
+	Enabled bool `json:"enabled,omitempty"`
+	// Roles the app database user is a member of, like db_datareader, db_datawriter, db_ddladmin or custom roles.
+	// The user is removed from the roles that aren't listed. Falls back to db_owner when neither roles nor
+	// schemaGrants are set, which is reported with a DefaultDatabaseRole Warning event and condition reason.
+	//+listType=set
+	Roles []string `json:"roles,omitempty"`
+	// SchemaGrants are the permissions granted to the app database user on whole schemas, the ones that aren't
+	// listed are revoked
+	SchemaGrants []SchemaGrant `json:"schemaGrants,omitempty"`
+	// EnvVars names the env vars the database connection details are injected into the app container as
+	EnvVars DatabaseEnvVars `json:"envVars,omitempty"`
+	// Migrations is the schema migration Job run before the deployment rolls out, it runs again whenever its image
+	// or command changes
+	Migrations *DatabaseMigrations `json:"migrations,omitempty"`
+}
+
+// DatabaseMigrations runs the app schema migrations as a Job with the app identity, it gets the same
+// AZURE_APP_ID, AZURE_APP_SECRET and database env vars as the app container
+type DatabaseMigrations struct {
+	// Image of the migration container
+	//+kubebuilder:validation:MinLength=1
+	Image string `json:"image"`
+	// Command of the migration container, the image entrypoint when empty
+	Command []string `json:"command,omitempty"`
+}
+
+// DatabaseEnvVars names the env vars, and the keys of the <identifier>-database secret, holding the app database
+// connection details. The ones left empty get their default name.
+type DatabaseEnvVars struct {
+	// Server holds the Azure SQL server host name, defaults to DB_SERVER
+	Server string `json:"server,omitempty"`
+	// Name holds the database name, defaults to DB_NAME
+	Name string `json:"name,omitempty"`
+	// ConnectionString holds a go-mssqldb connection string signing in as the app service principal, defaults
+	// to DB_CONNECTION_STRING
+	ConnectionString string `json:"connectionString,omitempty"`
+}
+
+// DefaultDatabaseServerEnvVar, DefaultDatabaseNameEnvVar and DefaultDatabaseConnectionStringEnvVar are the
+// database env vars of apps that don't name their own
+const (
+	DefaultDatabaseServerEnvVar           = "DB_SERVER"
+	DefaultDatabaseNameEnvVar             = "DB_NAME"
+	DefaultDatabaseConnectionStringEnvVar = "DB_CONNECTION_STRING"
+)
+
+// WithDefaults returns the env vars with the empty names set to their default
+func (e DatabaseEnvVars) WithDefaults() DatabaseEnvVars {
+	if e.Server == "" {
+		e.Server = DefaultDatabaseServerEnvVar
+	}
+	if e.Name == "" {
+		e.Name = DefaultDatabaseNameEnvVar
+	}
+	if e.ConnectionString == "" {
+		e.ConnectionString = DefaultDatabaseConnectionStringEnvVar
+	}
+	return e
+}
+
+// SchemaGrant grants permissions on a database schema
+type SchemaGrant struct {
+	// Schema the permissions are granted on
+	//+kubebuilder:validation:MinLength=1
+	//+kubebuilder:validation:MaxLength=128
+	Schema string `json:"schema"`
+	// Permissions granted on the schema
+	//+kubebuilder:validation:MinItems=1
+	//+listType=set
+	Permissions []SchemaPermission `json:"permissions"`
+}
+
+//+kubebuilder:validation:Enum=SELECT;INSERT;UPDATE;DELETE;EXECUTE;REFERENCES;ALTER;CONTROL;VIEW DEFINITION
+
+// SchemaPermission is a permission that can be granted on a schema
+type SchemaPermission string
+
+// DefaultDatabaseRole is the role of app database users that don't set roles or schemaGrants
+const DefaultDatabaseRole = "db_owner"
+
+// ApprovalPolicy defines which terraform plans need a manual approval
+type ApprovalPolicy string
+
+const (
+	// ApprovalAuto applies every plan
+	ApprovalAuto ApprovalPolicy = "auto"
+	// ApprovalManual waits for approval of every plan with changes
+	ApprovalManual ApprovalPolicy = "manual"
+	// ApprovalManualOnDestroy waits for approval of plans that destroy or replace resources
+	ApprovalManualOnDestroy ApprovalPolicy = "manualOnDestroy"
+)
+
+// ApprovedPlanAnnotation approves the plan whose hash, from status.lastPlan.hash, matches its value
+const ApprovedPlanAnnotation = "azureapp.rda.dev/approved-plan"
+
+// PausedAnnotation suspends the app like spec.suspend when set to "true"
+const PausedAnnotation = "azureapp.rda.dev/paused"
+
+// DeletionPolicy defines what deleting an AzureApp does to its Azure resources
+type DeletionPolicy string
+
+const (
+	// DeletionDelete destroys the Azure resources and deletes the terraform state
+	DeletionDelete DeletionPolicy = "Delete"
+	// DeletionRetain keeps the Azure resources and the terraform state, an AzureApp with the same name adopts them again
+	DeletionRetain DeletionPolicy = "Retain"
+	// DeletionOrphan keeps the Azure resources and archives the terraform state under a tombstone key
+	DeletionOrphan DeletionPolicy = "Orphan"
+)
+
+// DriftDetectionMode defines what the controller does once it detects drift
+type DriftDetectionMode string
+
+const (
+	// DriftRemediate applies the plan that reverts the drift
+	DriftRemediate DriftDetectionMode = "remediate"
+	// DriftReport only reports the drift on status and events
+	DriftReport DriftDetectionMode = "report"
+)
+
+// ResyncPeriodAnnotation sets the drift detection interval of an app when spec.driftDetection.interval is not set
+const ResyncPeriodAnnotation = "azureapp.rda.dev/resync-period"
+
+// DriftDetection configures the periodic terraform plan of an unchanged spec
+type DriftDetection struct {
+	// Interval between drift detection plans, defaults to the resync period annotation or the operator DRIFT_DETECTION_INTERVAL
+	Interval *metav1.Duration `json:"interval,omitempty"`
+	// Mode is remediate, to apply the plan that reverts drift, or report, to only report it
+	//+kubebuilder:validation:Enum=remediate;report
+	//+kubebuilder:default=remediate
+	Mode DriftDetectionMode `json:"mode,omitempty"`
+}
+
+// AzureAppStatus defines the observed state of AzureApp
+type AzureAppStatus struct {
+	Deployment        string `json:"deployment,omitempty"`
+	ProvisioningState string `json:"provisioningState,omitempty"`
+	// SpecHash is the hash of the spec and rendered terraform inputs that were last planned or applied successfully
+	SpecHash string `json:"specHash,omitempty"`
+	// LastAppliedTime is when terraform last applied changes successfully
+	LastAppliedTime *metav1.Time `json:"lastAppliedTime,omitempty"`
+	// LastPlanTime is when terraform last planned successfully, the next plan for an unchanged spec only runs
+	// once the drift detection interval has passed since then
+	LastPlanTime *metav1.Time `json:"lastPlanTime,omitempty"`
+	// LastPlan summarizes the last terraform plan of the app
+	LastPlan *PlanSummary `json:"lastPlan,omitempty"`
+	// Certificate is the tls certificate version served by the app ingress
+	Certificate *CertificateStatus `json:"certificate,omitempty"`
+	// Database describes the access of the app database user
+	Database *DatabaseStatus `json:"database,omitempty"`
+	// KeyVaultSecrets are the key vault secret versions projected into the app pods, in the order of the spec
+	KeyVaultSecrets []KeyVaultSecretStatus `json:"keyVaultSecrets,omitempty"`
+	// Migration is the last schema migration Job that succeeded
+	Migration *MigrationStatus `json:"migration,omitempty"`
+	// ObservedGeneration is the last AzureApp generation the controller fully reconciled
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Conditions represent the latest observations of each reconcile phase of the app
+	//+listType=map
+	//+listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
+}
+
+// PlanSummary describes what a terraform plan does to Azure. It only holds resource addresses and actions,
+// attribute values are never copied so sensitive values stay out of the status.
+type PlanSummary struct {
+	// Add is the number of resources the plan creates, replaced resources included
+	Add int `json:"add"`
+	// Change is the number of resources the plan updates in place
+	Change int `json:"change"`
+	// Destroy is the number of resources the plan destroys, replaced resources included
+	Destroy int `json:"destroy"`
+	// Resources lists the address and action of each resource the plan changes
+	Resources []PlannedResource `json:"resources,omitempty"`
+	// Hash identifies the changes of the plan, planning the same changes again gives the same hash
+	Hash string `json:"hash,omitempty"`
+	// InputsHash identifies the spec and rendered terraform inputs the plan was made for
+	InputsHash string `json:"inputsHash,omitempty"`
+	// Time is when the plan was made
+	Time metav1.Time `json:"time,omitempty"`
+}
+
+// CertificateStatus describes the Key Vault certificate synced into the app tls secret
+type CertificateStatus struct {
+	// Version is the Key Vault certificate version held by the tls secret
+	Version string `json:"version,omitempty"`
+	// NotAfter is when that certificate version expires
+	NotAfter *metav1.Time `json:"notAfter,omitempty"`
+}
+
+// DatabaseStatus describes the roles and schema permissions applied to the app database user
+type DatabaseStatus struct {
+	// User is the contained database user of the app
+	User string `json:"user"`
+	// Roles the user is a member of
+	Roles []string `json:"roles,omitempty"`
+	// SchemaPermissions granted to the user, as PERMISSION ON SCHEMA::schema
+	SchemaPermissions []string `json:"schemaPermissions,omitempty"`
+}
+
+// KeyVaultSecretStatus describes a Key Vault secret synced into the app key vault secrets secret
+type KeyVaultSecretStatus struct {
+	// Name of the secret in the app key vault
+	Name string `json:"name"`
+	// Version of the secret synced
+	Version string `json:"version"`
+}
+
+// MigrationStatus describes the schema migration Job that last succeeded
+type MigrationStatus struct {
+	// Job is the name of the migration Job
+	Job string `json:"job"`
+	// Image the Job ran
+	Image string `json:"image"`
+	// CompletionTime is when the Job succeeded
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+}
+
+// PlannedResource is a resource changed by a terraform plan
+type PlannedResource struct {
+	// Address is the terraform resource address
+	Address string `json:"address"`
+	// Action is one of create, update, delete or replace
+	Action string `json:"action"`
+}
+
+// Condition types set on AzureApp status, one per reconcile phase, drift and the overall Ready
+const (
+	ConditionTerraformPlanned       = "TerraformPlanned"
+	ConditionAzureResourcesReady    = "AzureResourcesReady"
+	ConditionDatabaseUserReady      = "DatabaseUserReady"
+	ConditionDatabaseMigrated       = "DatabaseMigrated"
+	ConditionCertificateReady       = "CertificateReady"
+	ConditionKubernetesObjectsReady = "KubernetesObjectsReady"
+	ConditionDriftDetected          = "DriftDetected"
+	ConditionSuspended              = "Suspended"
+	ConditionReady                  = "Ready"
+)
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:storageversion
+//+kubebuilder:printcolumn:JSONPath=".status.deployment",name="Deployment",type="string"
+//+kubebuilder:printcolumn:JSONPath=".status.provisioningState",name="ProvisioningState",type="string"
+//+kubebuilder:printcolumn:JSONPath=".status.conditions[?(@.type==\"Ready\")].status",name="Ready",type="string"
+//+kubebuilder:printcolumn:JSONPath=".metadata.creationTimestamp",name="Age",type="date"
+
+// AzureApp is the Schema for the azureapps API
+type AzureApp struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   AzureAppSpec   `json:"spec,omitempty"`
+	Status AzureAppStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// AzureAppList contains a list of AzureApp
+type AzureAppList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []AzureApp `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&AzureApp{}, &AzureAppList{})
+}
@@ -0,0 +1,297 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"text/template"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// log is for logging in this package.
+var azureapplog = logf.Log.WithName("azureapp-resource")
+
+// reservedEnvVars are set by the controller on the app container and can't be overridden by spec.envVars
+var reservedEnvVars = []string{"AZURE_APP_ID", "AZURE_APP_SECRET"}
+
+func (r *AzureApp) SetupWebhookWithManager(mgr ctrl.Manager, defaulter *AzureAppDefaulter) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		WithDefaulter(defaulter).
+		Complete()
+}
+
+//+kubebuilder:webhook:path=/mutate-k8sapp-rda-dev-v1alpha1-azureapp,mutating=true,failurePolicy=fail,sideEffects=None,groups=k8sapp.rda.dev,resources=azureapps,verbs=create;update,versions=v1alpha1,name=mazureapp.kb.io,admissionReviewVersions=v1
+
+//+kubebuilder:object:generate=false
+
+// AzureAppDefaulter fills in the empty AzureApp fields that can be derived from its name and namespace,
+// writing the resolved values back to the spec
+type AzureAppDefaulter struct {
+	// URLTemplate renders spec.url from the AzureApp .Name, .Namespace and .Identifier, spec.url is left
+	// empty when it's nil
+	URLTemplate *template.Template
+}
+
+// DefaultServingPort, DefaultReplicas and DefaultCertificateName are set on apps that don't set their own
+const (
+	DefaultServingPort     int32 = 8080
+	DefaultReplicas        int32 = 1
+	DefaultCertificateName       = "tls"
+)
+
+var _ admission.CustomDefaulter = &AzureAppDefaulter{}
+
+// Default implements admission.CustomDefaulter so a webhook will be registered for the type
+func (d *AzureAppDefaulter) Default(ctx context.Context, obj runtime.Object) error {
+	r, ok := obj.(*AzureApp)
+	if !ok {
+		return fmt.Errorf("expected an AzureApp but got a %T", obj)
+	}
+	azureapplog.Info("default", "name", r.Name)
+	if r.Spec.Identifier == "" {
+		r.Spec.Identifier = r.Name
+	}
+	if r.Spec.AzureAD.IdentifierURI == "" {
+		r.Spec.AzureAD.IdentifierURI = fmt.Sprintf("api://%s", r.Spec.Identifier)
+	}
+	if r.Spec.Networking.Url == "" && d.URLTemplate != nil {
+		var url bytes.Buffer
+		data := map[string]string{"Name": r.Name, "Namespace": r.Namespace, "Identifier": r.Spec.Identifier}
+		if err := d.URLTemplate.Execute(&url, data); err != nil {
+			return fmt.Errorf("error rendering url template: %w", err)
+		}
+		r.Spec.Networking.Url = url.String()
+	}
+	if r.Spec.Networking.ServingPort == 0 {
+		r.Spec.Networking.ServingPort = DefaultServingPort
+	}
+	if r.Spec.Workload.Replicas == nil {
+		replicas := DefaultReplicas
+		r.Spec.Workload.Replicas = &replicas
+	}
+	if r.Spec.TLS.CertificateName == "" {
+		r.Spec.TLS.CertificateName = DefaultCertificateName
+	}
+	if r.Spec.Database.Enabled {
+		r.Spec.Database.EnvVars = r.Spec.Database.EnvVars.WithDefaults()
+	}
+	return nil
+}
+
+//+kubebuilder:webhook:path=/validate-k8sapp-rda-dev-v1alpha1-azureapp,mutating=false,failurePolicy=fail,sideEffects=None,groups=k8sapp.rda.dev,resources=azureapps,verbs=create;update,versions=v1alpha1,name=vazureapp.kb.io,admissionReviewVersions=v1
+
+var _ webhook.Validator = &AzureApp{}
+
+// ValidateCreate implements webhook.Validator so a webhook will be registered for the type
+func (r *AzureApp) ValidateCreate() error {
+	azureapplog.Info("validate create", "name", r.Name)
+	return r.validateAzureApp(nil)
+}
+
+// ValidateUpdate implements webhook.Validator so a webhook will be registered for the type
+func (r *AzureApp) ValidateUpdate(old runtime.Object) error {
+	azureapplog.Info("validate update", "name", r.Name)
+	oldApp, ok := old.(*AzureApp)
+	if !ok {
+		return fmt.Errorf("expected an AzureApp but got a %T", old)
+	}
+	// the finalizer must be removable from apps created before validation existed
+	if !r.DeletionTimestamp.IsZero() {
+		return nil
+	}
+	return r.validateAzureApp(oldApp)
+}
+
+// ValidateDelete implements webhook.Validator so a webhook will be registered for the type
+func (r *AzureApp) ValidateDelete() error {
+	return nil
+}
+
+// validateAzureApp checks what the CRD OpenAPI schema can't: required fields, reserved env vars and, on update,
+// immutable fields. Formats and lengths are validated by the schema markers on AzureAppSpec.
+func (r *AzureApp) validateAzureApp(old *AzureApp) error {
+	var allErrs field.ErrorList
+	specPath := field.NewPath("spec")
+	if r.Spec.Identifier == "" {
+		allErrs = append(allErrs, field.Required(specPath.Child("identifier"), "names the app Azure and kubernetes resources"))
+	}
+	if r.Spec.AzureAD.IdentifierURI == "" {
+		allErrs = append(allErrs, field.Required(specPath.Child("azureAD", "identifierUri"), "sets the app registration identifier uri"))
+	}
+	if r.Spec.Networking.ServingPort == 0 {
+		allErrs = append(allErrs, field.Required(specPath.Child("networking", "servingPort"), "sets the app service port"))
+	}
+	for _, name := range reservedEnvVars {
+		if _, ok := r.Spec.Workload.EnvVars[name]; ok {
+			allErrs = append(allErrs, field.Forbidden(specPath.Child("workload", "envVars").Key(name), "is set by the controller"))
+		}
+	}
+	allErrs = append(allErrs, r.validateKeyVaultSecrets(specPath.Child("keyVaultSecrets"))...)
+	allErrs = append(allErrs, r.validateDatabase(specPath.Child("database"))...)
+	tlsPath := specPath.Child("tls")
+	var tlsOptions []string
+	if r.Spec.TLS.Issuer != nil {
+		tlsOptions = append(tlsOptions, "issuer")
+	}
+	if r.Spec.TLS.SelfSigned {
+		tlsOptions = append(tlsOptions, "selfSigned")
+	}
+	if r.Spec.TLS.Disabled {
+		tlsOptions = append(tlsOptions, "disabled")
+	}
+	if len(tlsOptions) > 1 {
+		allErrs = append(allErrs, field.Forbidden(tlsPath, fmt.Sprintf("only one of issuer, selfSigned and disabled can be set, got %s", strings.Join(tlsOptions, " and "))))
+	}
+	if (r.Spec.TLS.Issuer != nil || r.Spec.TLS.SelfSigned) && r.Spec.Networking.Url == "" {
+		allErrs = append(allErrs, field.Required(specPath.Child("networking", "url"), "is the subject of the certificate created by the operator"))
+	}
+	if old != nil && old.Spec.Identifier != "" && r.Spec.Identifier != old.Spec.Identifier {
+		allErrs = append(allErrs, field.Invalid(specPath.Child("identifier"), r.Spec.Identifier, "is immutable"))
+	}
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return apierrors.NewInvalid(GroupVersion.WithKind("AzureApp").GroupKind(), r.Name, allErrs)
+}
+
+// validateDatabase checks the database user roles and schema grants are valid SQL names, they only apply to apps
+// with a database
+func (r *AzureApp) validateDatabase(path *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	if !r.Spec.Database.Enabled {
+		if len(r.Spec.Database.Roles) > 0 {
+			allErrs = append(allErrs, field.Forbidden(path.Child("roles"), "requires database.enabled"))
+		}
+		if len(r.Spec.Database.SchemaGrants) > 0 {
+			allErrs = append(allErrs, field.Forbidden(path.Child("schemaGrants"), "requires database.enabled"))
+		}
+		if r.Spec.Database.Migrations != nil {
+			allErrs = append(allErrs, field.Forbidden(path.Child("migrations"), "requires database.enabled"))
+		}
+	}
+	if r.Spec.Database.EnvVars != (DatabaseEnvVars{}) {
+		if r.Spec.Database.Enabled {
+			allErrs = append(allErrs, r.validateDatabaseEnvVars(path.Child("envVars"))...)
+		} else {
+			allErrs = append(allErrs, field.Forbidden(path.Child("envVars"), "requires database.enabled"))
+		}
+	}
+	for i, role := range r.Spec.Database.Roles {
+		if role == "" || len([]rune(role)) > 128 {
+			allErrs = append(allErrs, field.Invalid(path.Child("roles").Index(i), role, "must have between 1 and 128 characters"))
+		}
+	}
+	schemas := make(map[string]bool)
+	for i, grant := range r.Spec.Database.SchemaGrants {
+		if schemas[grant.Schema] {
+			allErrs = append(allErrs, field.Duplicate(path.Child("schemaGrants").Index(i).Child("schema"), grant.Schema))
+		}
+		schemas[grant.Schema] = true
+	}
+	return allErrs
+}
+
+// validateDatabaseEnvVars checks the database env vars are valid and don't take a name the app container already
+// gets from the workload, the key vault secrets or the controller
+func (r *AzureApp) validateDatabaseEnvVars(path *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	taken := make(map[string]string)
+	for _, name := range reservedEnvVars {
+		taken[name] = "is set by the controller"
+	}
+	for name := range r.Spec.Workload.EnvVars {
+		taken[name] = "is already set by spec.workload.envVars"
+	}
+	for _, secret := range r.Spec.KeyVaultSecrets {
+		if secret.EnvVar != "" {
+			taken[secret.EnvVar] = "is already set by spec.keyVaultSecrets"
+		}
+	}
+	seen := make(map[string]bool)
+	envVars := r.Spec.Database.EnvVars.WithDefaults()
+	for _, envVar := range []struct {
+		field string
+		name  string
+	}{
+		{"server", envVars.Server},
+		{"name", envVars.Name},
+		{"connectionString", envVars.ConnectionString},
+	} {
+		envVarPath := path.Child(envVar.field)
+		for _, msg := range validation.IsEnvVarName(envVar.name) {
+			allErrs = append(allErrs, field.Invalid(envVarPath, envVar.name, msg))
+		}
+		if reason, ok := taken[envVar.name]; ok {
+			allErrs = append(allErrs, field.Forbidden(envVarPath, reason))
+		}
+		if seen[envVar.name] {
+			allErrs = append(allErrs, field.Duplicate(envVarPath, envVar.name))
+		}
+		seen[envVar.name] = true
+	}
+	return allErrs
+}
+
+// validateKeyVaultSecrets checks each key vault secret is projected once, as an env var or a file. Both end up
+// as keys of the same secret, so an env var and a file key can't share a name either.
+func (r *AzureApp) validateKeyVaultSecrets(path *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	keys := make(map[string]bool)
+	for i, secret := range r.Spec.KeyVaultSecrets {
+		secretPath := path.Index(i)
+		key := secret.EnvVar
+		switch {
+		case secret.EnvVar != "" && secret.FileKey != "":
+			allErrs = append(allErrs, field.Forbidden(secretPath, "only one of envVar and fileKey can be set"))
+			continue
+		case secret.EnvVar != "":
+			for _, msg := range validation.IsEnvVarName(secret.EnvVar) {
+				allErrs = append(allErrs, field.Invalid(secretPath.Child("envVar"), secret.EnvVar, msg))
+			}
+			if _, ok := r.Spec.Workload.EnvVars[secret.EnvVar]; ok {
+				allErrs = append(allErrs, field.Forbidden(secretPath.Child("envVar"), "is already set by spec.workload.envVars"))
+			}
+			for _, name := range reservedEnvVars {
+				if secret.EnvVar == name {
+					allErrs = append(allErrs, field.Forbidden(secretPath.Child("envVar"), "is set by the controller"))
+				}
+			}
+		case secret.FileKey != "":
+			key = secret.FileKey
+		default:
+			allErrs = append(allErrs, field.Required(secretPath, "one of envVar and fileKey sets where the secret is projected"))
+			continue
+		}
+		if keys[key] {
+			allErrs = append(allErrs, field.Duplicate(secretPath, key))
+		}
+		keys[key] = true
+	}
+	return allErrs
+}
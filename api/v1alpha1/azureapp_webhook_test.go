@@ -0,0 +1,267 @@
+package v1alpha1
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"text/template"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func validAzureApp() *AzureApp {
+	return &AzureApp{
+		ObjectMeta: metav1.ObjectMeta{Name: "app1"},
+		Spec: AzureAppSpec{
+			Identifier: "apprda001",
+			AzureAD:    AzureADSpec{IdentifierURI: "api://appuri1"},
+			Workload:   WorkloadSpec{Image: "nginx", EnvVars: map[string]string{"var1": "value1"}},
+			Networking: NetworkingSpec{ServingPort: 8080},
+		},
+	}
+}
+
+func TestValidateCreate(t *testing.T) {
+	tests := []struct {
+		name   string
+		mutate func(*AzureApp)
+		errs   []string
+	}{
+		{name: "valid", mutate: func(*AzureApp) {}},
+		{name: "empty identifier", mutate: func(a *AzureApp) { a.Spec.Identifier = "" }, errs: []string{"spec.identifier: Required value"}},
+		{name: "empty identifierUri", mutate: func(a *AzureApp) { a.Spec.AzureAD.IdentifierURI = "" }, errs: []string{"spec.azureAD.identifierUri: Required value"}},
+		{name: "zero servingPort", mutate: func(a *AzureApp) { a.Spec.Networking.ServingPort = 0 }, errs: []string{"spec.networking.servingPort: Required value"}},
+		{
+			name: "reserved env vars",
+			mutate: func(a *AzureApp) {
+				a.Spec.Workload.EnvVars["AZURE_APP_ID"], a.Spec.Workload.EnvVars["AZURE_APP_SECRET"] = "id", "secret"
+			},
+			errs: []string{"spec.workload.envVars[AZURE_APP_ID]: Forbidden", "spec.workload.envVars[AZURE_APP_SECRET]: Forbidden"},
+		},
+		{
+			name: "self-signed certificate",
+			mutate: func(a *AzureApp) {
+				a.Spec.Networking.Url = "myapp.local.dev"
+				a.Spec.TLS.SelfSigned = true
+			},
+		},
+		{
+			name: "conflicting tls options",
+			mutate: func(a *AzureApp) {
+				a.Spec.Networking.Url = "myapp.local.dev"
+				a.Spec.TLS = TLSSpec{Issuer: &CertificateIssuer{Name: "digicert"}, SelfSigned: true, Disabled: true}
+			},
+			errs: []string{"spec.tls: Forbidden: only one of issuer, selfSigned and disabled can be set, got issuer and selfSigned and disabled"},
+		},
+		{
+			name:   "created certificate without url",
+			mutate: func(a *AzureApp) { a.Spec.TLS.Issuer = &CertificateIssuer{Name: "digicert"} },
+			errs:   []string{"spec.networking.url: Required value"},
+		},
+		{name: "disabled tls without url", mutate: func(a *AzureApp) { a.Spec.TLS.Disabled = true }},
+		{
+			name: "database roles and schema grants",
+			mutate: func(a *AzureApp) {
+				a.Spec.Database = DatabaseSpec{
+					Enabled:      true,
+					Roles:        []string{"db_datareader", "app reporting"},
+					SchemaGrants: []SchemaGrant{{Schema: "sales", Permissions: []SchemaPermission{"SELECT", "EXECUTE"}}},
+				}
+			},
+		},
+		{
+			name: "invalid database roles and schema grants",
+			mutate: func(a *AzureApp) {
+				a.Spec.Database = DatabaseSpec{
+					Roles: []string{"", strings.Repeat("r", 129)},
+					SchemaGrants: []SchemaGrant{
+						{Schema: "sales", Permissions: []SchemaPermission{"SELECT"}},
+						{Schema: "sales", Permissions: []SchemaPermission{"EXECUTE"}},
+					},
+				}
+			},
+			errs: []string{
+				"spec.database.roles: Forbidden: requires database.enabled",
+				"spec.database.schemaGrants: Forbidden: requires database.enabled",
+				"spec.database.roles[0]: Invalid value",
+				"spec.database.roles[1]: Invalid value",
+				"spec.database.schemaGrants[1].schema: Duplicate value: \"sales\"",
+			},
+		},
+		{
+			name: "database env vars",
+			mutate: func(a *AzureApp) {
+				a.Spec.Database = DatabaseSpec{Enabled: true, EnvVars: DatabaseEnvVars{Server: "SQL_HOST", ConnectionString: "SQLCONNSTR_app"}}
+			},
+		},
+		{
+			name: "invalid database env vars",
+			mutate: func(a *AzureApp) {
+				a.Spec.Workload.EnvVars["DB_NAME"] = "mydb"
+				a.Spec.KeyVaultSecrets = []KeyVaultSecret{{Name: "db-connection", EnvVar: "DB_CONNECTION"}}
+				a.Spec.Database = DatabaseSpec{Enabled: true, EnvVars: DatabaseEnvVars{Server: "DB_CONNECTION", ConnectionString: "1NVALID"}}
+			},
+			errs: []string{
+				"spec.database.envVars.server: Forbidden: is already set by spec.keyVaultSecrets",
+				"spec.database.envVars.name: Forbidden: is already set by spec.workload.envVars",
+				"spec.database.envVars.connectionString: Invalid value",
+			},
+		},
+		{
+			name: "duplicate and reserved database env vars",
+			mutate: func(a *AzureApp) {
+				a.Spec.Database = DatabaseSpec{Enabled: true, EnvVars: DatabaseEnvVars{Server: "AZURE_APP_ID", Name: "DB", ConnectionString: "DB"}}
+			},
+			errs: []string{
+				"spec.database.envVars.server: Forbidden: is set by the controller",
+				"spec.database.envVars.connectionString: Duplicate value: \"DB\"",
+			},
+		},
+		{
+			name: "database migrations",
+			mutate: func(a *AzureApp) {
+				a.Spec.Database = DatabaseSpec{Enabled: true, Migrations: &DatabaseMigrations{Image: "migrate:v1", Command: []string{"migrate", "up"}}}
+			},
+		},
+		{
+			name:   "database migrations without database",
+			mutate: func(a *AzureApp) { a.Spec.Database.Migrations = &DatabaseMigrations{Image: "migrate:v1"} },
+			errs:   []string{"spec.database.migrations: Forbidden: requires database.enabled"},
+		},
+		{
+			name:   "database env vars without database",
+			mutate: func(a *AzureApp) { a.Spec.Database.EnvVars.Server = "SQL_HOST" },
+			errs:   []string{"spec.database.envVars: Forbidden: requires database.enabled"},
+		},
+		{
+			name: "key vault secrets",
+			mutate: func(a *AzureApp) {
+				a.Spec.KeyVaultSecrets = []KeyVaultSecret{
+					{Name: "db-connection", EnvVar: "DB_CONNECTION"},
+					{Name: "api-key", FileKey: "api-key.txt", Version: "0123456789abcdef"},
+				}
+			},
+		},
+		{
+			name: "invalid key vault secrets",
+			mutate: func(a *AzureApp) {
+				a.Spec.KeyVaultSecrets = []KeyVaultSecret{
+					{Name: "both", EnvVar: "BOTH", FileKey: "both"},
+					{Name: "neither"},
+					{Name: "taken", EnvVar: "var1"},
+					{Name: "reserved", EnvVar: "AZURE_APP_ID"},
+					{Name: "invalid", EnvVar: "1NVALID"},
+					{Name: "file", FileKey: "SHARED"},
+					{Name: "env", EnvVar: "SHARED"},
+				}
+			},
+			errs: []string{
+				"spec.keyVaultSecrets[0]: Forbidden: only one of envVar and fileKey can be set",
+				"spec.keyVaultSecrets[1]: Required value",
+				"spec.keyVaultSecrets[2].envVar: Forbidden: is already set by spec.workload.envVars",
+				"spec.keyVaultSecrets[3].envVar: Forbidden: is set by the controller",
+				"spec.keyVaultSecrets[4].envVar: Invalid value",
+				"spec.keyVaultSecrets[6]: Duplicate value: \"SHARED\"",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			azapp := validAzureApp()
+			tt.mutate(azapp)
+			assertErrors(t, azapp.ValidateCreate(), tt.errs)
+		})
+	}
+}
+
+func TestValidateUpdate(t *testing.T) {
+	old := validAzureApp()
+	renamed := validAzureApp()
+	renamed.Spec.Identifier = "apprda002"
+	assertErrors(t, renamed.ValidateUpdate(old), []string{"spec.identifier: Invalid value: \"apprda002\": is immutable"})
+
+	changed := validAzureApp()
+	changed.Spec.Workload.Image = "nginx:1.23"
+	assertErrors(t, changed.ValidateUpdate(old), nil)
+
+	// apps being deleted must be able to drop their finalizer even if their spec is no longer valid
+	deleting := validAzureApp()
+	deleting.Spec.Identifier = ""
+	now := metav1.Now()
+	deleting.DeletionTimestamp = &now
+	assertErrors(t, deleting.ValidateUpdate(old), nil)
+}
+
+func assertErrors(t *testing.T, err error, want []string) {
+	t.Helper()
+	if len(want) == 0 {
+		if err != nil {
+			t.Errorf("expected no error, got %s", err)
+		}
+		return
+	}
+	if err == nil {
+		t.Fatalf("expected errors %v, got none", want)
+	}
+	for _, w := range want {
+		if !strings.Contains(err.Error(), w) {
+			t.Errorf("expected error to contain %q, got %s", w, err)
+		}
+	}
+}
+
+func TestDefault(t *testing.T) {
+	defaulter := &AzureAppDefaulter{URLTemplate: template.Must(template.New("url").Parse("{{ .Identifier }}.{{ .Namespace }}.example.com"))}
+	minimal := &AzureApp{
+		ObjectMeta: metav1.ObjectMeta{Name: "app1", Namespace: "team-a"},
+		Spec:       AzureAppSpec{Workload: WorkloadSpec{Image: "nginx"}},
+	}
+	if err := defaulter.Default(context.Background(), minimal); err != nil {
+		t.Fatal(err)
+	}
+	if minimal.Spec.Identifier != "app1" || minimal.Spec.AzureAD.IdentifierURI != "api://app1" || minimal.Spec.Networking.Url != "app1.team-a.example.com" ||
+		minimal.Spec.Networking.ServingPort != 8080 || minimal.Spec.Workload.Replicas == nil || *minimal.Spec.Workload.Replicas != 1 ||
+		minimal.Spec.TLS.CertificateName != "tls" || minimal.Spec.Database.Roles != nil {
+		t.Errorf("unexpected defaults %+v", minimal.Spec)
+	}
+	if err := minimal.ValidateCreate(); err != nil {
+		t.Errorf("defaulted app is invalid: %s", err)
+	}
+
+	replicas := int32(3)
+	set := validAzureApp()
+	set.Spec.Networking.Url = "myapp.local.dev"
+	set.Spec.Workload.Replicas = &replicas
+	want := set.Spec
+	if err := defaulter.Default(context.Background(), set); err != nil {
+		t.Fatal(err)
+	}
+	if set.Spec.Identifier != want.Identifier || set.Spec.AzureAD.IdentifierURI != want.AzureAD.IdentifierURI || set.Spec.Networking.Url != want.Networking.Url ||
+		set.Spec.Networking.ServingPort != want.Networking.ServingPort || *set.Spec.Workload.Replicas != 3 {
+		t.Errorf("defaulting overwrote set fields: %+v", set.Spec)
+	}
+
+	withDatabase := validAzureApp()
+	withDatabase.Spec.Database.Enabled = true
+	if err := defaulter.Default(context.Background(), withDatabase); err != nil {
+		t.Fatal(err)
+	}
+	if roles := withDatabase.Spec.Database.Roles; roles != nil {
+		t.Errorf("expected the database roles to be left unset so the controller can warn about db_owner, got %v", roles)
+	}
+	wantEnvVars := DatabaseEnvVars{Server: "DB_SERVER", Name: "DB_NAME", ConnectionString: "DB_CONNECTION_STRING"}
+	if envVars := withDatabase.Spec.Database.EnvVars; envVars != wantEnvVars {
+		t.Errorf("expected database env vars %+v, got %+v", wantEnvVars, envVars)
+	}
+	if envVars := minimal.Spec.Database.EnvVars; envVars != (DatabaseEnvVars{}) {
+		t.Errorf("an app without a database shouldn't get database env vars, got %+v", envVars)
+	}
+	leastPrivilege := validAzureApp()
+	leastPrivilege.Spec.Database = DatabaseSpec{Enabled: true, SchemaGrants: []SchemaGrant{{Schema: "sales", Permissions: []SchemaPermission{"SELECT"}}}}
+	if err := defaulter.Default(context.Background(), leastPrivilege); err != nil {
+		t.Fatal(err)
+	}
+	if roles := leastPrivilege.Spec.Database.Roles; roles != nil {
+		t.Errorf("an app with schema grants shouldn't get a default role, got %v", roles)
+	}
+}
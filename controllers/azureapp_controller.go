@@ -18,36 +18,69 @@ package controllers
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"time"
 
 	"github.com/go-logr/logr"
+	"go.opentelemetry.io/otel/attribute"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	k8serr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	crmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
-	k8sappv0alpha1 "github.com/rdalbuquerque/azure-operator/operator/api/v0alpha1"
+	k8sappv1alpha1 "github.com/rdalbuquerque/azure-operator/operator/api/v1alpha1"
+	"github.com/rdalbuquerque/azure-operator/operator/controllers/config"
+	"github.com/rdalbuquerque/azure-operator/operator/controllers/internal/az"
 	"github.com/rdalbuquerque/azure-operator/operator/controllers/internal/dependencies"
 	"github.com/rdalbuquerque/azure-operator/operator/controllers/internal/kubeobjects"
+	"github.com/rdalbuquerque/azure-operator/operator/controllers/internal/metrics"
+	"github.com/rdalbuquerque/azure-operator/operator/controllers/tracing"
 )
 
 // AzureAppReconciler reconciles a AzureApp object
 type AzureAppReconciler struct {
 	client.Client
 	Scheme     *runtime.Scheme
+	Recorder   record.EventRecorder
 	BaseDir    string
 	kubeclient *kubeobjects.KubeClient
+	// reconcileRequests queues reconciles asked from outside the controller, see requestReconcile
+	reconcileRequests chan event.GenericEvent
 }
 
 var applyOpts = []client.PatchOption{client.ForceOwnership, client.FieldOwner("azureapp-controller")}
 
+// terraformRunner is the part of the terraform client reconcileTerraform plans and applies with
+type terraformRunner interface {
+	CheckTerraformableExternalDependencies(ctx context.Context, azapp *k8sappv1alpha1.AzureApp) (string, bool, error)
+	ManageTerraformableExternalDependencies(ctx context.Context, azapp *k8sappv1alpha1.AzureApp, phase string, planfile string) error
+	SummarizePlan(ctx context.Context, planfile string) (*k8sappv1alpha1.PlanSummary, error)
+	DiscardPlan(planfile string) error
+	InputsHash() string
+}
+
 //+kubebuilder:rbac:groups=k8sapp.rda.dev,resources=azureapps,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=k8sapp.rda.dev,resources=azureapps/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=k8sapp.rda.dev,resources=azureapps/finalizers,verbs=update
 //+kubebuilder:rbac:groups=*,resources=*,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups="",resources=events,verbs=create;patch
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -67,84 +100,467 @@ var applyOpts = []client.PatchOption{client.ForceOwnership, client.FieldOwner("a
 //
 // 2- once external dependencies are good to go, manage kubernetes objects
 func (r *AzureAppReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	ctx, span := tracing.Start(ctx, "Reconcile",
+		attribute.String("azureapp.name", req.Name),
+		attribute.String("azureapp.namespace", req.Namespace),
+	)
+	result, err := r.reconcile(ctx, req)
+	tracing.End(span, err)
+	return result, err
+}
+
+// reconcile runs the reconcile phases, terraform, Azure and SQL calls made here are traced as children of the Reconcile span
+func (r *AzureAppReconciler) reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	logr := logr.FromContextOrDiscard(ctx)
 	logr.Info("Initializing reconcile loop")
 
 	// map azure app being reconciled into azapp object
-	azapp := k8sappv0alpha1.AzureApp{}
+	azapp := k8sappv1alpha1.AzureApp{}
 	if err := r.Get(ctx, req.NamespacedName, &azapp); err != nil {
 		return ctrl.Result{}, client.IgnoreNotFound(err)
 	}
 
-	// initiates clients
+	// initiates clients, the terraform client renders the app workdir so it's only built once terraform runs
 	r.kubeclient = kubeobjects.NewKubeClient(ctx, r.Client, applyOpts)
-	tfclient, err := dependencies.NewTerraformClient(ctx, &azapp)
-	if err != nil {
-		logr.Info("error initiating terraform client")
-		return ctrl.Result{}, err
+	newTfClient := func() (*dependencies.TfDependenciesClient, error) {
+		tfclient, err := dependencies.NewTerraformClient(ctx, &azapp)
+		if err != nil {
+			logr.Info("error initiating terraform client")
+			r.Recorder.Event(&azapp, corev1.EventTypeWarning, "TerraformClientFailed", err.Error())
+		}
+		return tfclient, err
 	}
 
 	// setup finalizer and evaluate DeletionTimestamp, if it's not zero, executes cleanup and removes finalizer
-	if objdeleted, err := r.ManageFinalizer(ctx, azapp, tfclient); err != nil {
+	if objdeleted, err := r.ManageFinalizer(ctx, azapp, newTfClient); err != nil {
 		return ctrl.Result{}, err
 	} else if objdeleted {
 		return ctrl.Result{}, nil
 	}
 
-	// reconcile external dependencies
-	planfile, tfchanged, err := tfclient.CheckTerraformableExternalDependencies(ctx, &azapp)
+	// a suspended app doesn't run terraform, kube apply or certificate polling until it's resumed
+	if condition, transition := suspendTransition(&azapp); condition != nil {
+		if transition {
+			r.Recorder.Event(&azapp, corev1.EventTypeNormal, condition.Reason, condition.Message)
+		}
+		if err := r.kubeclient.SetConditions(&azapp, *condition); err != nil {
+			return ctrl.Result{}, ignoreConflict(ctx, err)
+		}
+	}
+	if suspended(&azapp) {
+		logr.Info("AzureApp is suspended, skipping reconcile")
+		return ctrl.Result{}, nil
+	}
+
+	tfclient, err := newTfClient()
 	if err != nil {
 		return ctrl.Result{}, err
 	}
-	if tfchanged {
-		logr.Info("Reconciling AzureApp")
-		if err := r.kubeclient.SetProvisionState("Reconciling external dependencies", &azapp); err != nil {
-			return ctrl.Result{}, ignoreConflict(ctx, err)
-		}
-		start := time.Now()
-		if err := tfclient.ManageTerraformableExternalDependencies(ctx, &azapp, "apply", planfile); err != nil {
-			return ctrl.Result{}, fmt.Errorf("error managing terraform dependencies: %s", err)
-		}
-		elapsed := time.Since(start)
-		logr.Info(fmt.Sprintf("Done terraform apply of app [%s], apply duration: %v", azapp.Name, elapsed))
-		if err := dependencies.ManageOtherExternalDependencies(&azapp); err != nil {
-			return ctrl.Result{}, fmt.Errorf("error managing other dependencies: %s", err)
+
+	// reconcile external dependencies, terraform only runs when the inputs changed or drift detection is due
+	if approvalPending(&azapp, tfclient.InputsHash()) {
+		// setting the approval annotation triggers a reconcile, the requeue only refreshes the pending plan
+		logr.Info("Terraform plan is awaiting approval, skipping terraform")
+		return ctrl.Result{RequeueAfter: driftDetectionInterval(&azapp) - time.Since(azapp.Status.LastPlan.Time.Time)}, nil
+	} else if terraformUpToDate(&azapp, tfclient.InputsHash()) {
+		logr.Info("Terraform inputs unchanged since last plan, skipping terraform")
+	} else if result, err := r.reconcileTerraform(ctx, &azapp, tfclient); err != nil || !result.IsZero() {
+		return result, err
+	}
+
+	// database roles and grants aren't terraform inputs, they're applied whenever they differ from status
+	if !equality.Semantic.DeepEqual(dependencies.DatabaseStatus(&azapp), azapp.Status.Database) {
+		if result, err := r.reconcileDatabaseUser(ctx, &azapp); err != nil || !result.IsZero() {
+			return result, err
 		}
+	}
 
+	cert, result, err := r.reconcileCertificate(ctx, &azapp)
+	if err != nil || !result.IsZero() {
+		return result, err
 	}
 
-	logr.Info("Checking certificate")
-	ok, err := dependencies.CheckCertificate(&azapp)
+	kvSecrets, err := r.reconcileKeyVaultSecrets(ctx, &azapp)
 	if err != nil {
 		return ctrl.Result{}, err
 	}
-	if !ok {
-		err := r.kubeclient.SetProvisionState("Waiting certificate", &azapp)
-		return ctrl.Result{RequeueAfter: time.Duration(30) * time.Second}, ignoreConflict(ctx, err)
-	}
 
 	// reconcile kubernetes objects
-	azappk8s, err := r.buildKubeObjects(ctx, azapp)
+	azappk8s, err := r.buildKubeObjects(ctx, azapp, tfclient, cert, kvSecrets)
 	if err != nil {
-		return ctrl.Result{}, err
+		return ctrl.Result{}, r.markFailed(ctx, &azapp, k8sappv1alpha1.ConditionKubernetesObjectsReady, "BuildFailed", err)
+	}
+	// the deployment only rolls out once the schema migration of the current spec succeeded
+	if migrated, result, err := r.reconcileMigrations(ctx, &azapp, azappk8s); !migrated {
+		return result, err
 	}
 	if err := r.kubeclient.ApplyAll(azappk8s); err != nil {
+		if k8serr.IsConflict(err) {
+			return ctrl.Result{}, ignoreConflict(ctx, err)
+		}
+		return ctrl.Result{}, r.markFailed(ctx, &azapp, k8sappv1alpha1.ConditionKubernetesObjectsReady, "ApplyFailed", err)
+	}
+	if !azapp.Spec.Database.Enabled {
+		// a connection secret published before the database was disabled is no longer referenced by the deployment
+		staleSecret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: databaseSecretName(&azapp), Namespace: azapp.Namespace}}
+		if err := r.Delete(ctx, staleSecret); client.IgnoreNotFound(err) != nil {
+			return ctrl.Result{}, r.markFailed(ctx, &azapp, k8sappv1alpha1.ConditionKubernetesObjectsReady, "ApplyFailed", err)
+		}
+	}
+	if err := r.kubeclient.SetCertificateStatus(certificateStatus(cert), &azapp); err != nil {
+		return ctrl.Result{}, ignoreConflict(ctx, err)
+	}
+	if err := r.kubeclient.SetKeyVaultSecretsStatus(keyVaultSecretsStatus(&azapp, kvSecrets), &azapp); err != nil {
 		return ctrl.Result{}, ignoreConflict(ctx, err)
 	}
 	if err := r.kubeclient.SetDeploymentName(azapp.Spec.Identifier, &azapp); err != nil {
 		return ctrl.Result{}, ignoreConflict(ctx, err)
 	}
-	if err := r.kubeclient.SetProvisionState("Provisioned", &azapp); err != nil {
+	if err := r.markProvisioned(&azapp); err != nil {
 		return ctrl.Result{}, ignoreConflict(ctx, err)
 	}
 	logr.Info(fmt.Sprintf("Successfully reconciled AzureApp: %s", azapp.Name))
+	return ctrl.Result{RequeueAfter: nextDriftCheck(&azapp)}, nil
+}
+
+// markProvisioned sets the Ready condition once the kube objects of the app are applied and records the
+// generation they were applied from in status.observedGeneration
+func (r *AzureAppReconciler) markProvisioned(azapp *k8sappv1alpha1.AzureApp) error {
+	// kube objects are applied on every reconcile, the event is only recorded when the app becomes provisioned
+	if !meta.IsStatusConditionTrue(azapp.Status.Conditions, k8sappv1alpha1.ConditionReady) || azapp.Status.ObservedGeneration != azapp.Generation {
+		r.Recorder.Event(azapp, corev1.EventTypeNormal, "Provisioned", fmt.Sprintf("Applied deployment, service and ingress %s", azapp.Spec.Identifier))
+	}
+	if err := r.kubeclient.SetConditions(azapp,
+		newCondition(k8sappv1alpha1.ConditionKubernetesObjectsReady, metav1.ConditionTrue, "Applied", "Kubernetes objects are applied"),
+		newCondition(k8sappv1alpha1.ConditionReady, metav1.ConditionTrue, "Provisioned", "AzureApp is provisioned"),
+	); err != nil {
+		return err
+	}
+	if err := r.kubeclient.SetObservedGeneration(azapp); err != nil {
+		return err
+	}
+	return r.kubeclient.SetProvisionState("Provisioned", azapp)
+}
+
+// reconcileCertificate gets the certificate served by the app ingress, creating it first when spec.tls asks the
+// operator to. The certificate is nil when tls is disabled, a non zero result means Reconcile must stop and
+// return it.
+func (r *AzureAppReconciler) reconcileCertificate(ctx context.Context, azapp *k8sappv1alpha1.AzureApp) (*az.TlsCertificate, ctrl.Result, error) {
+	logr := logr.FromContextOrDiscard(ctx)
+	if azapp.Spec.TLS.Disabled {
+		// a tls secret synced before tls was disabled is no longer served
+		staleSecret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: tlsSecretName(azapp), Namespace: azapp.Namespace}}
+		if err := r.Delete(ctx, staleSecret); client.IgnoreNotFound(err) != nil {
+			return nil, ctrl.Result{}, err
+		}
+		err := r.kubeclient.SetConditions(azapp,
+			newCondition(k8sappv1alpha1.ConditionCertificateReady, metav1.ConditionTrue, "TLSDisabled", "spec.tls.disabled is set, the ingress is served without tls"),
+		)
+		return nil, ctrl.Result{}, ignoreConflict(ctx, err)
+	}
+
+	logr.Info("Checking certificate")
+	cert, err := dependencies.GetCertificate(ctx, azapp)
+	if err != nil {
+		return nil, ctrl.Result{}, r.markFailed(ctx, azapp, k8sappv1alpha1.ConditionCertificateReady, "CertificateCheckFailed", err)
+	}
+	if cert == nil {
+		waiting := fmt.Sprintf("Waiting for tls certificate %s in the app key vault", dependencies.CertificateName(azapp))
+		if dependencies.CertificateRequested(azapp) {
+			if err := dependencies.RequestCertificate(ctx, azapp); err != nil {
+				return nil, ctrl.Result{}, r.markFailed(ctx, azapp, k8sappv1alpha1.ConditionCertificateReady, "CertificateRequestFailed", err)
+			}
+			waiting = fmt.Sprintf("Waiting for tls certificate %s requested by the operator to be issued in the app key vault", dependencies.CertificateName(azapp))
+		}
+		// the wait backs off on its own, terraform isn't planned again while inputs are unchanged
+		wait := certificateWait(azapp)
+		reason := "CertificateMissing"
+		if wait > config.Config.CertificateWaitTimeout {
+			reason = "CertificateTimeout"
+			// the message must not change between checks, a status patch would trigger the next check right away
+			waiting = fmt.Sprintf("%s, still missing after %v", waiting, config.Config.CertificateWaitTimeout)
+			if !conditionHasReason(azapp, k8sappv1alpha1.ConditionCertificateReady, reason) {
+				r.Recorder.Event(azapp, corev1.EventTypeWarning, reason, waiting)
+			}
+		} else if !conditionHasReason(azapp, k8sappv1alpha1.ConditionCertificateReady, reason) {
+			r.Recorder.Event(azapp, corev1.EventTypeNormal, "WaitingCertificate", waiting)
+		}
+		if err := r.kubeclient.SetConditions(azapp,
+			newCondition(k8sappv1alpha1.ConditionCertificateReady, metav1.ConditionFalse, reason, waiting),
+			newCondition(k8sappv1alpha1.ConditionReady, metav1.ConditionFalse, "WaitingCertificate", waiting),
+		); err != nil {
+			return nil, ctrl.Result{}, ignoreConflict(ctx, err)
+		}
+		err := r.kubeclient.SetProvisionState("Waiting certificate", azapp)
+		return nil, ctrl.Result{RequeueAfter: certificateBackoff(wait, config.Config.CertificateWaitMaxInterval)}, ignoreConflict(ctx, err)
+	}
+	// the certificate is synced into the tls secret along with the other kube objects
+	certMessage := certificateMessage(cert, azapp)
+	if !conditionHasReason(azapp, k8sappv1alpha1.ConditionCertificateReady, "CertificateFound") {
+		r.Recorder.Event(azapp, corev1.EventTypeNormal, "CertificateFound", certMessage)
+	} else if meta.FindStatusCondition(azapp.Status.Conditions, k8sappv1alpha1.ConditionCertificateReady).Message != certMessage {
+		r.Recorder.Event(azapp, corev1.EventTypeNormal, "CertificateUpdated", certMessage)
+	}
+	err = r.kubeclient.SetConditions(azapp,
+		newCondition(k8sappv1alpha1.ConditionCertificateReady, metav1.ConditionTrue, "CertificateFound", certMessage),
+	)
+	return cert, ctrl.Result{}, ignoreConflict(ctx, err)
+}
+
+// reconcileKeyVaultSecrets reads the spec.keyVaultSecrets values from the app key vault, they're synced into their
+// secret along with the other kube objects and kept up to date by the KeyVaultSecretWatcher
+func (r *AzureAppReconciler) reconcileKeyVaultSecrets(ctx context.Context, azapp *k8sappv1alpha1.AzureApp) ([]az.Secret, error) {
+	if len(azapp.Spec.KeyVaultSecrets) == 0 {
+		// a secret synced before spec.keyVaultSecrets was emptied is no longer used
+		staleSecret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: keyVaultSecretsName(azapp), Namespace: azapp.Namespace}}
+		return nil, client.IgnoreNotFound(r.Delete(ctx, staleSecret))
+	}
+	kvSecrets, err := dependencies.GetKeyVaultSecrets(ctx, azapp)
+	if err != nil {
+		return nil, r.markFailed(ctx, azapp, k8sappv1alpha1.ConditionKubernetesObjectsReady, "KeyVaultSecretsFailed", err)
+	}
+	return kvSecrets, nil
+}
+
+// reconcileMigrations runs spec.database.migrations as a Job when its image or command changed since the last
+// migration that succeeded, applying every kube object but the deployment first so the Job gets the app identity.
+// It reports if the deployment can roll out, otherwise Reconcile must stop and return the result and error. The
+// deployment is held until the Job succeeds, the app owns the Job so its status changes queue the next reconcile.
+func (r *AzureAppReconciler) reconcileMigrations(ctx context.Context, azapp *k8sappv1alpha1.AzureApp, azappk8s []client.Object) (bool, ctrl.Result, error) {
+	if azapp.Spec.Database.Migrations == nil {
+		if azapp.Status.Migration == nil {
+			return true, ctrl.Result{}, nil
+		}
+		// migrations were removed from the spec, their last Job is no longer needed
+		if err := r.deleteMigrationJobs(ctx, azapp, ""); err != nil {
+			return false, ctrl.Result{}, err
+		}
+		if err := r.kubeclient.SetMigrationStatus(nil, azapp); err != nil {
+			return false, ctrl.Result{Requeue: true}, ignoreConflict(ctx, err)
+		}
+		return true, ctrl.Result{}, nil
+	}
+	desired, err := r.desiredMigrationJob(azapp)
+	if err != nil {
+		return false, ctrl.Result{}, r.markFailed(ctx, azapp, k8sappv1alpha1.ConditionDatabaseMigrated, "BuildFailed", err)
+	}
+	if azapp.Status.Migration != nil && azapp.Status.Migration.Job == desired.Name {
+		return true, ctrl.Result{}, nil
+	}
+
+	job := &batchv1.Job{}
+	err = r.Get(ctx, client.ObjectKeyFromObject(&desired), job)
+	if k8serr.IsNotFound(err) {
+		var predeploy []client.Object
+		for _, obj := range azappk8s {
+			if _, ok := obj.(*appsv1.Deployment); !ok {
+				predeploy = append(predeploy, obj)
+			}
+		}
+		if err := r.kubeclient.ApplyAll(append(predeploy, &desired)); err != nil {
+			return false, ctrl.Result{}, r.markFailed(ctx, azapp, k8sappv1alpha1.ConditionDatabaseMigrated, "MigrationFailed", err)
+		}
+		r.Recorder.Event(azapp, corev1.EventTypeNormal, "MigrationStarted",
+			fmt.Sprintf("Started migration job %s with image %s", desired.Name, azapp.Spec.Database.Migrations.Image))
+		job = &desired
+	} else if err != nil {
+		return false, ctrl.Result{}, err
+	}
+
+	if failed := jobCondition(job, batchv1.JobFailed); failed != nil {
+		// retrying the same Job can't succeed, a new image or command runs a new one and deleting it runs it again
+		message := fmt.Sprintf("Migration job %s failed: %s", job.Name, failed.Message)
+		if !conditionHasReason(azapp, k8sappv1alpha1.ConditionDatabaseMigrated, "MigrationFailed") {
+			r.Recorder.Event(azapp, corev1.EventTypeWarning, "MigrationFailed", message)
+		}
+		if err := r.kubeclient.SetConditions(azapp,
+			newCondition(k8sappv1alpha1.ConditionDatabaseMigrated, metav1.ConditionFalse, "MigrationFailed", message),
+			newCondition(k8sappv1alpha1.ConditionReady, metav1.ConditionFalse, "MigrationFailed", message),
+		); err != nil {
+			return false, ctrl.Result{Requeue: true}, ignoreConflict(ctx, err)
+		}
+		return false, ctrl.Result{}, nil
+	}
+	if complete := jobCondition(job, batchv1.JobComplete); complete == nil {
+		waiting := fmt.Sprintf("Waiting for migration job %s to complete, the deployment is held until it succeeds", job.Name)
+		if err := r.kubeclient.SetConditions(azapp,
+			newCondition(k8sappv1alpha1.ConditionDatabaseMigrated, metav1.ConditionFalse, "MigrationRunning", waiting),
+			newCondition(k8sappv1alpha1.ConditionReady, metav1.ConditionFalse, "MigrationRunning", waiting),
+		); err != nil {
+			return false, ctrl.Result{Requeue: true}, ignoreConflict(ctx, err)
+		}
+		if err := r.kubeclient.SetProvisionState("Migrating database", azapp); err != nil {
+			return false, ctrl.Result{Requeue: true}, ignoreConflict(ctx, err)
+		}
+		return false, ctrl.Result{}, nil
+	}
+
+	message := fmt.Sprintf("Migration job %s with image %s succeeded", job.Name, azapp.Spec.Database.Migrations.Image)
+	r.Recorder.Event(azapp, corev1.EventTypeNormal, "MigrationSucceeded", message)
+	// the Jobs of earlier migrations, succeeded or superseded while running, are no longer needed
+	if err := r.deleteMigrationJobs(ctx, azapp, job.Name); err != nil {
+		return false, ctrl.Result{}, err
+	}
+	if err := r.kubeclient.SetConditions(azapp,
+		newCondition(k8sappv1alpha1.ConditionDatabaseMigrated, metav1.ConditionTrue, "MigrationSucceeded", message),
+	); err != nil {
+		return false, ctrl.Result{Requeue: true}, ignoreConflict(ctx, err)
+	}
+	migration := &k8sappv1alpha1.MigrationStatus{Job: job.Name, Image: azapp.Spec.Database.Migrations.Image, CompletionTime: job.Status.CompletionTime}
+	if err := r.kubeclient.SetMigrationStatus(migration, azapp); err != nil {
+		return false, ctrl.Result{Requeue: true}, ignoreConflict(ctx, err)
+	}
+	return true, ctrl.Result{}, nil
+}
+
+// deleteMigrationJobs deletes the migration Jobs of the app other than keep, along with their pods
+func (r *AzureAppReconciler) deleteMigrationJobs(ctx context.Context, azapp *k8sappv1alpha1.AzureApp, keep string) error {
+	jobs := &batchv1.JobList{}
+	if err := r.List(ctx, jobs, client.InNamespace(azapp.Namespace),
+		client.MatchingLabels{"azureapp": azapp.Spec.Identifier, migrationJobLabel: "true"}); err != nil {
+		return err
+	}
+	for i := range jobs.Items {
+		if jobs.Items[i].Name == keep {
+			continue
+		}
+		if err := r.Delete(ctx, &jobs.Items[i], client.PropagationPolicy(metav1.DeletePropagationBackground)); client.IgnoreNotFound(err) != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reconcileDatabaseUser sets up the app database user with its spec.database roles and schema grants, revoking the
+// ones no longer listed, and records them in status. A non zero result means Reconcile must stop and return it.
+func (r *AzureAppReconciler) reconcileDatabaseUser(ctx context.Context, azapp *k8sappv1alpha1.AzureApp) (ctrl.Result, error) {
+	dbStatus, err := dependencies.ManageOtherExternalDependencies(ctx, azapp)
+	if err != nil {
+		err = fmt.Errorf("error managing other dependencies: %w", err)
+		return ctrl.Result{}, r.markFailed(ctx, azapp, k8sappv1alpha1.ConditionDatabaseUserReady, "DatabaseUserFailed", err)
+	}
+	condition := databaseUserCondition(azapp, dbStatus)
+	if condition.Reason == "DefaultDatabaseRole" {
+		r.Recorder.Event(azapp, corev1.EventTypeWarning, "DefaultDatabaseRole", condition.Message)
+	} else if dbStatus != nil {
+		r.Recorder.Event(azapp, corev1.EventTypeNormal, "DatabaseUserReady", condition.Message)
+	}
+	if err := r.kubeclient.SetConditions(azapp, condition); err != nil {
+		return ctrl.Result{Requeue: true}, ignoreConflict(ctx, err)
+	}
+	if err := r.kubeclient.SetDatabaseStatus(dbStatus, azapp); err != nil {
+		return ctrl.Result{Requeue: true}, ignoreConflict(ctx, err)
+	}
+	return ctrl.Result{}, nil
+}
+
+// reconcileTerraform plans the terraform managed dependencies of the app and applies the plan when it has
+// changes, followed by the dependencies terraform can't manage. A non zero result means Reconcile must stop
+// and return it.
+func (r *AzureAppReconciler) reconcileTerraform(ctx context.Context, azapp *k8sappv1alpha1.AzureApp, tfclient terraformRunner) (ctrl.Result, error) {
+	logr := logr.FromContextOrDiscard(ctx)
+	// an unchanged spec is only planned again to detect drift, an approved plan of it is applied as is
+	driftCheck := azapp.Status.SpecHash == tfclient.InputsHash() && !conditionHasReason(azapp, k8sappv1alpha1.ConditionTerraformPlanned, "AwaitingApproval")
+	planfile, tfchanged, err := tfclient.CheckTerraformableExternalDependencies(ctx, azapp)
+	if err != nil {
+		return ctrl.Result{}, r.markFailed(ctx, azapp, k8sappv1alpha1.ConditionTerraformPlanned, "PlanFailed", err)
+	}
+	summary := &k8sappv1alpha1.PlanSummary{Time: metav1.Now()}
+	if tfchanged {
+		if summary, err = tfclient.SummarizePlan(ctx, planfile); err != nil {
+			return ctrl.Result{}, r.markFailed(ctx, azapp, k8sappv1alpha1.ConditionTerraformPlanned, "ShowPlanFailed", err)
+		}
+		summary.InputsHash = tfclient.InputsHash()
+		r.Recorder.Event(azapp, corev1.EventTypeNormal, "TerraformPlanned", planMessage(summary))
+	} else {
+		r.Recorder.Event(azapp, corev1.EventTypeNormal, "TerraformPlanned", "Terraform plan has no changes")
+	}
+	if err := r.kubeclient.SetLastPlan(summary, azapp); err != nil {
+		return ctrl.Result{Requeue: true}, ignoreConflict(ctx, err)
+	}
+	if driftCheck {
+		remediate, err := r.checkDrift(ctx, azapp, tfclient, planfile, summary)
+		if err != nil {
+			return ctrl.Result{}, r.markFailed(ctx, azapp, k8sappv1alpha1.ConditionTerraformPlanned, "DriftCheckFailed", err)
+		}
+		if tfchanged && !remediate {
+			if err := r.kubeclient.SetTerraformState(tfclient.InputsHash(), false, azapp); err != nil {
+				return ctrl.Result{Requeue: true}, ignoreConflict(ctx, err)
+			}
+			return ctrl.Result{}, nil
+		}
+	}
+	if tfchanged && !planApproved(azapp, summary) {
+		return r.awaitApproval(ctx, azapp, tfclient, planfile, summary)
+	}
+	if tfchanged {
+		logr.Info("Reconciling AzureApp")
+		if err := r.kubeclient.SetConditions(azapp,
+			newCondition(k8sappv1alpha1.ConditionTerraformPlanned, metav1.ConditionTrue, "ChangesPending", "Terraform plan has changes to apply"),
+			newCondition(k8sappv1alpha1.ConditionAzureResourcesReady, metav1.ConditionFalse, "Applying", "Applying terraform plan"),
+			newCondition(k8sappv1alpha1.ConditionReady, metav1.ConditionFalse, "Reconciling", "Reconciling external dependencies"),
+		); err != nil {
+			return ctrl.Result{Requeue: true}, ignoreConflict(ctx, err)
+		}
+		if err := r.kubeclient.SetProvisionState("Reconciling external dependencies", azapp); err != nil {
+			return ctrl.Result{Requeue: true}, ignoreConflict(ctx, err)
+		}
+		r.Recorder.Event(azapp, corev1.EventTypeNormal, "TerraformApplying", "Applying terraform plan")
+		start := time.Now()
+		if err := tfclient.ManageTerraformableExternalDependencies(ctx, azapp, "apply", planfile); err != nil {
+			if errors.Is(err, dependencies.ErrStalePlan) {
+				logr.Info("Discarded stale terraform plan, planning again")
+				r.Recorder.Event(azapp, corev1.EventTypeNormal, "StalePlanDiscarded", "Saved terraform plan is stale, planning again")
+				return ctrl.Result{Requeue: true}, nil
+			}
+			err = fmt.Errorf("error managing terraform dependencies: %w", err)
+			return ctrl.Result{}, r.markFailed(ctx, azapp, k8sappv1alpha1.ConditionAzureResourcesReady, "ApplyFailed", err)
+		}
+		elapsed := time.Since(start)
+		logr.Info(fmt.Sprintf("Done terraform apply of app [%s], apply duration: %v", azapp.Name, elapsed))
+		r.Recorder.Event(azapp, corev1.EventTypeNormal, "TerraformApplied", fmt.Sprintf("Terraform apply finished in %v", elapsed.Round(time.Second)))
+		conditions := []metav1.Condition{
+			newCondition(k8sappv1alpha1.ConditionAzureResourcesReady, metav1.ConditionTrue, "Applied", fmt.Sprintf("Terraform apply finished in %v", elapsed.Round(time.Second))),
+		}
+		if driftCheck {
+			conditions = append(conditions, newCondition(k8sappv1alpha1.ConditionDriftDetected, metav1.ConditionFalse, "Remediated", "Drift was reverted by terraform apply"))
+		}
+		if err := r.kubeclient.SetConditions(azapp, conditions...); err != nil {
+			return ctrl.Result{Requeue: true}, ignoreConflict(ctx, err)
+		}
+		// the database may have just been created, its user is set up again even if status says it's up to date
+		if result, err := r.reconcileDatabaseUser(ctx, azapp); err != nil || !result.IsZero() {
+			return result, err
+		}
+	} else {
+		if err := r.kubeclient.SetConditions(azapp,
+			newCondition(k8sappv1alpha1.ConditionTerraformPlanned, metav1.ConditionTrue, "NoChanges", "Terraform plan has no changes"),
+			newCondition(k8sappv1alpha1.ConditionAzureResourcesReady, metav1.ConditionTrue, "UpToDate", "Azure resources match the desired state"),
+		); err != nil {
+			return ctrl.Result{Requeue: true}, ignoreConflict(ctx, err)
+		}
+	}
+	if err := r.kubeclient.SetTerraformState(tfclient.InputsHash(), tfchanged, azapp); err != nil {
+		return ctrl.Result{Requeue: true}, ignoreConflict(ctx, err)
+	}
 	return ctrl.Result{}, nil
 }
 
+// specOrAnnotationChanged only lets AzureApp updates that change the spec or an annotation, like the approval
+// or paused ones, queue a reconcile. Status patches made by Reconcile itself or by the watchers don't, so syncing
+// a certificate or key vault secret never ends up running terraform.
+var specOrAnnotationChanged = predicate.Or(predicate.GenerationChangedPredicate{}, predicate.AnnotationChangedPredicate{})
+
 // SetupWithManager sets up the controller with the Manager.
 func (r *AzureAppReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if err := crmetrics.Registry.Register(metrics.NewAppsCollector(mgr.GetClient())); err != nil {
+		return err
+	}
+	r.reconcileRequests = make(chan event.GenericEvent)
 	return ctrl.NewControllerManagedBy(mgr).
-		For(&k8sappv0alpha1.AzureApp{}).
+		For(&k8sappv1alpha1.AzureApp{}, builder.WithPredicates(specOrAnnotationChanged)).
+		Owns(&batchv1.Job{}).
+		Watches(&source.Channel{Source: r.reconcileRequests}, &handler.EnqueueRequestForObject{}).
 		WithOptions(controller.Options{
 			MaxConcurrentReconciles: 3,
 			LogConstructor: func(req *reconcile.Request) logr.Logger {
@@ -155,3 +571,62 @@ func (r *AzureAppReconciler) SetupWithManager(mgr ctrl.Manager) error {
 			}}).
 		Complete(r)
 }
+
+// requestReconcile queues a reconcile of the app, for the watchers whose changes have to go through the
+// reconciler to reach the deployment
+func (r *AzureAppReconciler) requestReconcile(ctx context.Context, azapp *k8sappv1alpha1.AzureApp) {
+	select {
+	case r.reconcileRequests <- event.GenericEvent{Object: azapp}:
+	case <-ctx.Done():
+	}
+}
+
+// checkDrift reports on the DriftDetected condition and events if the plan of an unchanged spec has changes,
+// returning if the plan should be applied to remediate them. Plans that are only reported get discarded.
+func (r *AzureAppReconciler) checkDrift(ctx context.Context, azapp *k8sappv1alpha1.AzureApp, tfclient terraformRunner, planfile string, plan *k8sappv1alpha1.PlanSummary) (bool, error) {
+	logr := logr.FromContextOrDiscard(ctx)
+	if len(plan.Resources) == 0 {
+		return true, r.kubeclient.SetConditions(azapp,
+			newCondition(k8sappv1alpha1.ConditionDriftDetected, metav1.ConditionFalse, "NoDrift", "Azure resources match the terraform configuration"),
+		)
+	}
+	summary := driftSummary(plan)
+	logr.Info(fmt.Sprintf("Drift detected for app [%s]: %s", azapp.Name, summary))
+	r.Recorder.Event(azapp, corev1.EventTypeWarning, "DriftDetected", summary)
+	if err := r.kubeclient.SetConditions(azapp,
+		newCondition(k8sappv1alpha1.ConditionDriftDetected, metav1.ConditionTrue, "DriftDetected", summary),
+	); err != nil {
+		return false, err
+	}
+	if driftDetectionMode(azapp) == k8sappv1alpha1.DriftReport {
+		return false, tfclient.DiscardPlan(planfile)
+	}
+	return true, nil
+}
+
+// awaitApproval discards a plan that needs a manual approval and stops the reconcile until the approval
+// annotation matches the plan hash, the plan is made again then and applied if its hash still matches. Its hash
+// and inputs hash stay in status.lastPlan, so the inputs aren't planned again while it waits.
+func (r *AzureAppReconciler) awaitApproval(ctx context.Context, azapp *k8sappv1alpha1.AzureApp, tfclient terraformRunner, planfile string, plan *k8sappv1alpha1.PlanSummary) (ctrl.Result, error) {
+	logr := logr.FromContextOrDiscard(ctx)
+	logr.Info(fmt.Sprintf("Plan %s of app [%s] is awaiting approval", plan.Hash, azapp.Name))
+	if err := tfclient.DiscardPlan(planfile); err != nil {
+		return ctrl.Result{}, r.markFailed(ctx, azapp, k8sappv1alpha1.ConditionTerraformPlanned, "DiscardPlanFailed", err)
+	}
+	message := fmt.Sprintf("%s. Approve with: kubectl annotate azureapp %s %s=%s --overwrite", planMessage(plan), azapp.Name, k8sappv1alpha1.ApprovedPlanAnnotation, plan.Hash)
+	// the event is only recorded for a new plan, not when the pending one is refreshed
+	if current := meta.FindStatusCondition(azapp.Status.Conditions, k8sappv1alpha1.ConditionTerraformPlanned); current == nil || current.Message != message {
+		r.Recorder.Event(azapp, corev1.EventTypeWarning, "AwaitingApproval", message)
+	}
+	if err := r.kubeclient.SetConditions(azapp,
+		newCondition(k8sappv1alpha1.ConditionTerraformPlanned, metav1.ConditionTrue, "AwaitingApproval", message),
+		newCondition(k8sappv1alpha1.ConditionReady, metav1.ConditionFalse, "AwaitingApproval", fmt.Sprintf("Terraform plan %s is awaiting approval", plan.Hash)),
+	); err != nil {
+		return ctrl.Result{Requeue: true}, ignoreConflict(ctx, err)
+	}
+	if err := r.kubeclient.SetProvisionState("Awaiting approval", azapp); err != nil {
+		return ctrl.Result{Requeue: true}, ignoreConflict(ctx, err)
+	}
+	// setting the annotation triggers a reconcile, the requeue only refreshes the pending plan
+	return ctrl.Result{RequeueAfter: driftDetectionInterval(azapp)}, nil
+}
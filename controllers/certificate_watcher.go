@@ -0,0 +1,188 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	k8sappv1alpha1 "github.com/rdalbuquerque/azure-operator/operator/api/v1alpha1"
+	"github.com/rdalbuquerque/azure-operator/operator/controllers/internal/az"
+	"github.com/rdalbuquerque/azure-operator/operator/controllers/internal/dependencies"
+	"github.com/rdalbuquerque/azure-operator/operator/controllers/internal/kubeobjects"
+)
+
+// watcherTick is how often the watchers look for apps whose check is due
+const watcherTick = time.Minute
+
+// CertificateWatcher checks the tls certificate of every provisioned app in its key vault on a schedule. A new
+// certificate version is synced into the app tls secret and status without a full reconcile, the status patch
+// doesn't queue one either, so no terraform runs. A Warning event is recorded while the certificate is about
+// to expire.
+type CertificateWatcher struct {
+	Reconciler *AzureAppReconciler
+	// Interval between two checks of the same app
+	Interval time.Duration
+	// ExpiryWarning is how long before the certificate expires the CertificateExpiring events start
+	ExpiryWarning time.Duration
+	// GetCertificate reads the app certificate from key vault, dependencies.GetCertificate when nil
+	GetCertificate func(ctx context.Context, azapp *k8sappv1alpha1.AzureApp) (*az.TlsCertificate, error)
+
+	tracker checkTracker
+}
+
+// NeedLeaderElection makes only the leader manager check certificates
+func (w *CertificateWatcher) NeedLeaderElection() bool {
+	return true
+}
+
+// Start checks the due apps every tick until ctx is done
+func (w *CertificateWatcher) Start(ctx context.Context) error {
+	logr := log.Log.WithName("certificate-watcher")
+	ctx = log.IntoContext(ctx, logr)
+	ticker := time.NewTicker(watcherTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := w.checkDue(ctx, time.Now()); err != nil {
+				logr.Error(err, "unable to check app certificates")
+			}
+		}
+	}
+}
+
+// checkDue checks the certificate of every watched app whose next check is due
+func (w *CertificateWatcher) checkDue(ctx context.Context, now time.Time) error {
+	logr := logr.FromContextOrDiscard(ctx)
+	azapps := &k8sappv1alpha1.AzureAppList{}
+	if err := w.Reconciler.List(ctx, azapps); err != nil {
+		return err
+	}
+	var watched []types.NamespacedName
+	for i := range azapps.Items {
+		azapp := &azapps.Items[i]
+		if !certificateWatched(azapp) {
+			continue
+		}
+		key := client.ObjectKeyFromObject(azapp)
+		watched = append(watched, key)
+		if !w.tracker.due(key, now, w.Interval) {
+			continue
+		}
+		if err := w.checkCertificate(ctx, azapp, now); err != nil {
+			logr.Error(err, "unable to check certificate", "app", azapp.Name, "namespace", azapp.Namespace)
+		}
+	}
+	w.tracker.retain(watched)
+	return nil
+}
+
+// certificateWatched tells if the app certificate is already synced and the watcher should keep it up to date,
+// apps still waiting on the certificate, suspended or being deleted are left to Reconcile
+func certificateWatched(azapp *k8sappv1alpha1.AzureApp) bool {
+	return azapp.Status.Certificate != nil && azapp.DeletionTimestamp.IsZero() && !suspended(azapp) &&
+		meta.IsStatusConditionTrue(azapp.Status.Conditions, k8sappv1alpha1.ConditionCertificateReady)
+}
+
+// checkCertificate syncs a new certificate version into the app tls secret and warns about its expiry
+func (w *CertificateWatcher) checkCertificate(ctx context.Context, azapp *k8sappv1alpha1.AzureApp, now time.Time) error {
+	getCertificate := w.GetCertificate
+	if getCertificate == nil {
+		getCertificate = dependencies.GetCertificate
+	}
+	cert, err := getCertificate(ctx, azapp)
+	if err != nil {
+		return err
+	}
+	if cert == nil {
+		// the certificate was removed from key vault, the secret keeps serving the last version synced
+		w.Reconciler.Recorder.Event(azapp, corev1.EventTypeWarning, "CertificateMissing",
+			fmt.Sprintf("tls certificate is missing from the app key vault, secret %s keeps version %s", tlsSecretName(azapp), azapp.Status.Certificate.Version))
+		return nil
+	}
+
+	if cert.Version != azapp.Status.Certificate.Version {
+		kubeclient := kubeobjects.NewKubeClient(ctx, w.Reconciler.Client, applyOpts)
+		secret, err := w.Reconciler.desiredTLSSecret(cert, azapp)
+		if err != nil {
+			return err
+		}
+		if err := kubeclient.ApplyAll([]client.Object{&secret}); err != nil {
+			return err
+		}
+		message := certificateMessage(cert, azapp)
+		w.Reconciler.Recorder.Event(azapp, corev1.EventTypeNormal, "CertificateUpdated", message)
+		if err := kubeclient.SetConditions(azapp,
+			newCondition(k8sappv1alpha1.ConditionCertificateReady, metav1.ConditionTrue, "CertificateFound", message),
+		); err != nil {
+			return err
+		}
+		if err := kubeclient.SetCertificateStatus(certificateStatus(cert), azapp); err != nil {
+			return err
+		}
+	}
+
+	if expiring, message := certificateExpiring(cert, now, w.ExpiryWarning); expiring {
+		w.Reconciler.Recorder.Event(azapp, corev1.EventTypeWarning, "CertificateExpiring", message)
+	}
+	return nil
+}
+
+// certificateExpiring tells if the certificate expires within window of now, with the event message saying when
+func certificateExpiring(cert *az.TlsCertificate, now time.Time, window time.Duration) (bool, string) {
+	if cert.NotAfter == nil || cert.NotAfter.Sub(now) > window {
+		return false, ""
+	}
+	if !cert.NotAfter.After(now) {
+		return true, fmt.Sprintf("tls certificate version %s expired at %s", cert.Version, cert.NotAfter.UTC().Format(time.RFC3339))
+	}
+	return true, fmt.Sprintf("tls certificate version %s expires at %s, renew it in the app key vault", cert.Version, cert.NotAfter.UTC().Format(time.RFC3339))
+}
+
+// checkTracker keeps when each watched app is checked next
+type checkTracker struct {
+	mu        sync.Mutex
+	nextCheck map[types.NamespacedName]time.Time
+}
+
+// due tells if the app should be checked now and schedules the next check when it should. An app seen for the
+// first time was just synced by Reconcile, so its first check is an interval away.
+func (t *checkTracker) due(key types.NamespacedName, now time.Time, interval time.Duration) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.nextCheck == nil {
+		t.nextCheck = make(map[types.NamespacedName]time.Time)
+	}
+	next, tracked := t.nextCheck[key]
+	if tracked && now.Before(next) {
+		return false
+	}
+	t.nextCheck[key] = now.Add(interval)
+	return tracked
+}
+
+// retain stops tracking the apps that are no longer watched
+func (t *checkTracker) retain(watched []types.NamespacedName) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	keep := make(map[types.NamespacedName]bool, len(watched))
+	for _, key := range watched {
+		keep[key] = true
+	}
+	for key := range t.nextCheck {
+		if !keep[key] {
+			delete(t.nextCheck, key)
+		}
+	}
+}
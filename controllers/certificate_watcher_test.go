@@ -0,0 +1,89 @@
+package controllers
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	k8sappv1alpha1 "github.com/rdalbuquerque/azure-operator/operator/api/v1alpha1"
+	"github.com/rdalbuquerque/azure-operator/operator/controllers/internal/az"
+)
+
+func TestCheckTrackerSchedulesChecks(t *testing.T) {
+	var tracker checkTracker
+	app := types.NamespacedName{Namespace: "default", Name: "app1"}
+	now := time.Now()
+
+	if tracker.due(app, now, time.Hour) {
+		t.Error("an app seen for the first time was just synced by Reconcile, it shouldn't be due")
+	}
+	if tracker.due(app, now.Add(30*time.Minute), time.Hour) {
+		t.Error("app was due before its interval passed")
+	}
+	if !tracker.due(app, now.Add(time.Hour), time.Hour) {
+		t.Error("app wasn't due once its interval passed")
+	}
+	if tracker.due(app, now.Add(90*time.Minute), time.Hour) {
+		t.Error("a check didn't schedule the next one")
+	}
+
+	tracker.retain(nil)
+	if tracker.due(app, now.Add(3*time.Hour), time.Hour) {
+		t.Error("an app that stopped being watched should start over when watched again")
+	}
+}
+
+func TestCertificateExpiring(t *testing.T) {
+	now := time.Date(2023, 5, 1, 0, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) *az.TlsCertificate {
+		notAfter := now.Add(d)
+		return &az.TlsCertificate{Version: "v1", NotAfter: &notAfter}
+	}
+	window := 30 * 24 * time.Hour
+
+	if expiring, _ := certificateExpiring(at(60*24*time.Hour), now, window); expiring {
+		t.Error("certificate expiring in 60 days is outside a 30 days window")
+	}
+	if expiring, message := certificateExpiring(at(10*24*time.Hour), now, window); !expiring || !strings.Contains(message, "expires at 2023-05-11T00:00:00Z") {
+		t.Errorf("expected an expiring warning, got %v %q", expiring, message)
+	}
+	if expiring, message := certificateExpiring(at(-time.Hour), now, window); !expiring || !strings.Contains(message, "expired at") {
+		t.Errorf("expected an expired warning, got %v %q", expiring, message)
+	}
+	if expiring, _ := certificateExpiring(&az.TlsCertificate{Version: "v1"}, now, window); expiring {
+		t.Error("certificate without expiry can't be expiring")
+	}
+}
+
+func TestStatusPatchesDontQueueReconcile(t *testing.T) {
+	old := &k8sappv1alpha1.AzureApp{ObjectMeta: metav1.ObjectMeta{Name: "app1", Generation: 2, Annotations: map[string]string{"a": "b"}}}
+	tests := []struct {
+		name   string
+		mutate func(*k8sappv1alpha1.AzureApp)
+		want   bool
+	}{
+		{name: "certificate status synced by the watcher", mutate: func(a *k8sappv1alpha1.AzureApp) {
+			a.Status.Certificate = &k8sappv1alpha1.CertificateStatus{Version: "v2"}
+		}},
+		{name: "key vault secrets status synced by the watcher", mutate: func(a *k8sappv1alpha1.AzureApp) {
+			a.Status.KeyVaultSecrets = []k8sappv1alpha1.KeyVaultSecretStatus{{Name: "api-key", Version: "v2"}}
+		}},
+		{name: "spec changed", mutate: func(a *k8sappv1alpha1.AzureApp) { a.Generation = 3 }, want: true},
+		{name: "plan approved", mutate: func(a *k8sappv1alpha1.AzureApp) {
+			a.Annotations = map[string]string{"a": "b", k8sappv1alpha1.ApprovedPlanAnnotation: "hash"}
+		}, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			updated := old.DeepCopy()
+			tt.mutate(updated)
+			if got := specOrAnnotationChanged.Update(event.UpdateEvent{ObjectOld: old, ObjectNew: updated}); got != tt.want {
+				t.Errorf("update queues a reconcile = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -3,6 +3,7 @@ package config
 import (
 	"fmt"
 	"os"
+	"time"
 )
 
 type ConfigOptions struct {
@@ -19,6 +20,14 @@ type ConfigOptions struct {
 	StorageAccount                 string
 	Container                      string
 	DefaultSQLServer               string
+	DriftDetectionInterval         time.Duration
+	URLTemplate                    string
+	CertificateCheckInterval       time.Duration
+	CertificateExpiryWarning       time.Duration
+	CertificateWaitMaxInterval     time.Duration
+	CertificateWaitTimeout         time.Duration
+	KeyVaultSecretRefreshInterval  time.Duration
+	OrphanedUserScanInterval       time.Duration
 }
 
 var Config = &ConfigOptions{}
@@ -34,6 +43,14 @@ func SetConfig() {
 	Config.TerraformBackendStorageAccount = getRequiredEnv("TF_BACKEND_STORAGE_ACCOUNT")
 	Config.TerraformBackendContainer = getEnv("TF_BACKEND_CONTAINER", "state")
 	Config.DefaultSQLServer = getRequiredEnv("DEFAULT_SQL_SERVER")
+	Config.DriftDetectionInterval = getDurationEnv("DRIFT_DETECTION_INTERVAL", time.Hour)
+	Config.URLTemplate = getEnv("URL_TEMPLATE", "")
+	Config.CertificateCheckInterval = getDurationEnv("CERTIFICATE_CHECK_INTERVAL", time.Hour)
+	Config.CertificateExpiryWarning = getDurationEnv("CERTIFICATE_EXPIRY_WARNING", 30*24*time.Hour)
+	Config.CertificateWaitMaxInterval = getDurationEnv("CERTIFICATE_WAIT_MAX_INTERVAL", 10*time.Minute)
+	Config.CertificateWaitTimeout = getDurationEnv("CERTIFICATE_WAIT_TIMEOUT", 24*time.Hour)
+	Config.KeyVaultSecretRefreshInterval = getDurationEnv("KEYVAULT_SECRET_REFRESH_INTERVAL", 5*time.Minute)
+	Config.OrphanedUserScanInterval = getDurationEnv("ORPHANED_USER_SCAN_INTERVAL", 24*time.Hour)
 }
 
 func getEnv(key string, defaultVal string) string {
@@ -43,6 +60,17 @@ func getEnv(key string, defaultVal string) string {
 	return defaultVal
 }
 
+func getDurationEnv(key string, defaultVal time.Duration) time.Duration {
+	if value, exists := os.LookupEnv(key); exists {
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			panic(fmt.Sprintf("Environment variable %s must be a duration: %s", key, err))
+		}
+		return duration
+	}
+	return defaultVal
+}
+
 func getRequiredEnv(key string) string {
 	if value, exists := os.LookupEnv(key); exists {
 		return value
@@ -2,17 +2,26 @@ package controllers
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/go-logr/logr"
-	k8sappv0alpha1 "github.com/rdalbuquerque/azure-operator/operator/api/v0alpha1"
+	k8sappv1alpha1 "github.com/rdalbuquerque/azure-operator/operator/api/v1alpha1"
+	"github.com/rdalbuquerque/azure-operator/operator/controllers/config"
+	"github.com/rdalbuquerque/azure-operator/operator/controllers/internal/az"
 	"github.com/rdalbuquerque/azure-operator/operator/controllers/internal/dependencies"
 	"github.com/rdalbuquerque/azure-operator/operator/controllers/internal/kubeobjects"
+	"github.com/rdalbuquerque/azure-operator/operator/controllers/internal/metrics"
 	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	networkingv1 "k8s.io/api/networking/v1"
 	k8serr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/intstr"
 	ctrl "sigs.k8s.io/controller-runtime"
@@ -22,31 +31,63 @@ import (
 
 var ErrFileNotExist = errors.New("spec file does not exist")
 
-func (r *AzureAppReconciler) desiredDeployment(azapp *k8sappv0alpha1.AzureApp, appCreds corev1.Secret) (appsv1.Deployment, error) {
+// certificateVersionAnnotation records on the tls secret the Key Vault certificate version it holds
+const certificateVersionAnnotation = "azureapp.rda.dev/certificate-version"
+
+// keyVaultSecretsHashAnnotation records on the key vault secrets secret and the app pod template which secret
+// versions are projected, so a new version rolls the app pods
+const keyVaultSecretsHashAnnotation = "azureapp.rda.dev/keyvault-secrets-hash"
+
+// desiredDeployment runs the app image, kvSecrets is the secret holding the spec.keyVaultSecrets values and is nil
+// when the app has none
+func (r *AzureAppReconciler) desiredDeployment(azapp *k8sappv1alpha1.AzureApp, appCreds corev1.Secret, kvSecrets *corev1.Secret) (appsv1.Deployment, error) {
 	replicas := new(int32)
-	*replicas = 1
+	*replicas = k8sappv1alpha1.DefaultReplicas
+	if azapp.Spec.Workload.Replicas != nil {
+		*replicas = *azapp.Spec.Workload.Replicas
+	}
 
 	var envVars []corev1.EnvVar
-	for k, v := range azapp.Spec.EnvVars {
+	for k, v := range azapp.Spec.Workload.EnvVars {
 		envVar := corev1.EnvVar{Name: k, Value: v}
 		envVars = append(envVars, envVar)
 	}
-	envVars = append(envVars, corev1.EnvVar{
-		Name: "AZURE_APP_ID",
-		ValueFrom: &corev1.EnvVarSource{
-			SecretKeyRef: &corev1.SecretKeySelector{
-				LocalObjectReference: corev1.LocalObjectReference{Name: appCreds.ObjectMeta.Name},
-				Key:                  "AZURE_APP_ID",
-			},
-		}})
-	envVars = append(envVars, corev1.EnvVar{
-		Name: "AZURE_APP_SECRET",
-		ValueFrom: &corev1.EnvVarSource{
-			SecretKeyRef: &corev1.SecretKeySelector{
-				LocalObjectReference: corev1.LocalObjectReference{Name: appCreds.ObjectMeta.Name},
-				Key:                  "AZURE_APP_SECRET",
-			},
-		}})
+	envVars = append(envVars, identityEnvVars(azapp, appCreds.ObjectMeta.Name)...)
+	var volumes []corev1.Volume
+	var volumeMounts []corev1.VolumeMount
+	var podAnnotations map[string]string
+	if kvSecrets != nil {
+		var files []corev1.KeyToPath
+		for _, kvSecret := range azapp.Spec.KeyVaultSecrets {
+			if kvSecret.FileKey != "" {
+				files = append(files, corev1.KeyToPath{Key: kvSecret.FileKey, Path: kvSecret.FileKey})
+				continue
+			}
+			envVars = append(envVars, corev1.EnvVar{
+				Name: kvSecret.EnvVar,
+				ValueFrom: &corev1.EnvVarSource{
+					SecretKeyRef: &corev1.SecretKeySelector{
+						LocalObjectReference: corev1.LocalObjectReference{Name: kvSecrets.Name},
+						Key:                  kvSecret.EnvVar,
+					},
+				}})
+		}
+		if len(files) > 0 {
+			volumes = append(volumes, corev1.Volume{
+				Name: "keyvault-secrets",
+				VolumeSource: corev1.VolumeSource{
+					Secret: &corev1.SecretVolumeSource{SecretName: kvSecrets.Name, Items: files},
+				},
+			})
+			volumeMounts = append(volumeMounts, corev1.VolumeMount{
+				Name:      "keyvault-secrets",
+				MountPath: k8sappv1alpha1.KeyVaultSecretsMountPath,
+				ReadOnly:  true,
+			})
+		}
+		// env vars are only read at startup, a new secret version must restart the pods
+		podAnnotations = map[string]string{keyVaultSecretsHashAnnotation: kvSecrets.Annotations[keyVaultSecretsHashAnnotation]}
+	}
 
 	depl := appsv1.Deployment{
 		TypeMeta: metav1.TypeMeta{APIVersion: appsv1.SchemeGroupVersion.String(), Kind: "Deployment"},
@@ -55,22 +96,25 @@ func (r *AzureAppReconciler) desiredDeployment(azapp *k8sappv0alpha1.AzureApp, a
 			Namespace: azapp.Namespace,
 		},
 		Spec: appsv1.DeploymentSpec{
-			Replicas: replicas, // won't be nil because defaulting
+			Replicas: replicas,
 			Selector: &metav1.LabelSelector{
 				MatchLabels: map[string]string{"azureapp": azapp.Spec.Identifier},
 			},
 			Template: corev1.PodTemplateSpec{
 				ObjectMeta: metav1.ObjectMeta{
-					Labels: map[string]string{"azureapp": azapp.Spec.Identifier},
+					Labels:      map[string]string{"azureapp": azapp.Spec.Identifier},
+					Annotations: podAnnotations,
 				},
 				Spec: corev1.PodSpec{
 					Containers: []corev1.Container{
 						{
-							Name:  azapp.Spec.Identifier,
-							Image: azapp.Spec.ContainerImage,
-							Env:   envVars,
+							Name:         azapp.Spec.Identifier,
+							Image:        azapp.Spec.Workload.Image,
+							Env:          envVars,
+							VolumeMounts: volumeMounts,
 						},
 					},
+					Volumes: volumes,
 				},
 			},
 		},
@@ -83,7 +127,101 @@ func (r *AzureAppReconciler) desiredDeployment(azapp *k8sappv0alpha1.AzureApp, a
 	return depl, nil
 }
 
-func (r *AzureAppReconciler) desiredIngress(azapp *k8sappv0alpha1.AzureApp) (networkingv1.Ingress, error) {
+// identityEnvVars are the env vars giving a container the app identity, its credentials from the appCreds secret
+// and, when it has a database, the connection details from the database secret
+func identityEnvVars(azapp *k8sappv1alpha1.AzureApp, appCreds string) []corev1.EnvVar {
+	secretEnvVar := func(name, secret string) corev1.EnvVar {
+		return corev1.EnvVar{
+			Name: name,
+			ValueFrom: &corev1.EnvVarSource{
+				SecretKeyRef: &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: secret},
+					Key:                  name,
+				},
+			}}
+	}
+	envVars := []corev1.EnvVar{
+		secretEnvVar("AZURE_APP_ID", appCreds),
+		secretEnvVar("AZURE_APP_SECRET", appCreds),
+	}
+	if azapp.Spec.Database.Enabled {
+		dbEnvVars := azapp.Spec.Database.EnvVars.WithDefaults()
+		for _, name := range []string{dbEnvVars.Server, dbEnvVars.Name, dbEnvVars.ConnectionString} {
+			envVars = append(envVars, secretEnvVar(name, databaseSecretName(azapp)))
+		}
+	}
+	return envVars
+}
+
+// migrationJobLabel marks the schema migration Jobs of an app
+const migrationJobLabel = "azureapp.rda.dev/migration"
+
+// migrationBackoffLimit is how many times a failed migration pod is retried before its Job fails
+const migrationBackoffLimit int32 = 3
+
+// migrationJobName names the migration Job after its image and command, so changing either runs a new Job
+func migrationJobName(azapp *k8sappv1alpha1.AzureApp) string {
+	migrations := azapp.Spec.Database.Migrations
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%q", migrations.Image, migrations.Command)
+	return fmt.Sprintf("%s-migrate-%s", azapp.Spec.Identifier, hex.EncodeToString(h.Sum(nil))[:10])
+}
+
+// desiredMigrationJob runs spec.database.migrations once with the app identity, the Job pod template can't change
+// so a new spec gets a new Job name
+func (r *AzureAppReconciler) desiredMigrationJob(azapp *k8sappv1alpha1.AzureApp) (batchv1.Job, error) {
+	backoffLimit := migrationBackoffLimit
+	labels := map[string]string{"azureapp": azapp.Spec.Identifier, migrationJobLabel: "true"}
+	job := batchv1.Job{
+		TypeMeta: metav1.TypeMeta{APIVersion: batchv1.SchemeGroupVersion.String(), Kind: "Job"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      migrationJobName(azapp),
+			Namespace: azapp.Namespace,
+			Labels:    labels,
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec: corev1.PodSpec{
+					RestartPolicy: corev1.RestartPolicyNever,
+					Containers: []corev1.Container{
+						{
+							Name:    "migrate",
+							Image:   azapp.Spec.Database.Migrations.Image,
+							Command: azapp.Spec.Database.Migrations.Command,
+							// the credentials secret is named after the app like the deployment
+							Env: identityEnvVars(azapp, azapp.Spec.Identifier),
+						},
+					},
+				},
+			},
+		},
+	}
+
+	if err := ctrl.SetControllerReference(azapp, &job, r.Scheme); err != nil {
+		return job, err
+	}
+
+	return job, nil
+}
+
+// jobCondition is the condition of job with type condType when it's true, nil otherwise
+func jobCondition(job *batchv1.Job, condType batchv1.JobConditionType) *batchv1.JobCondition {
+	for i := range job.Status.Conditions {
+		if job.Status.Conditions[i].Type == condType && job.Status.Conditions[i].Status == corev1.ConditionTrue {
+			return &job.Status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// tlsSecretName is the name of the kubernetes.io/tls secret holding the app certificate
+func tlsSecretName(azapp *k8sappv1alpha1.AzureApp) string {
+	return fmt.Sprintf("%s-tls", azapp.Spec.Identifier)
+}
+
+func (r *AzureAppReconciler) desiredIngress(azapp *k8sappv1alpha1.AzureApp) (networkingv1.Ingress, error) {
 	pathType := new(networkingv1.PathType)
 	*pathType = "Prefix"
 	ing := networkingv1.Ingress{
@@ -95,7 +233,7 @@ func (r *AzureAppReconciler) desiredIngress(azapp *k8sappv0alpha1.AzureApp) (net
 		Spec: networkingv1.IngressSpec{
 			Rules: []networkingv1.IngressRule{
 				{
-					Host: azapp.Spec.Url,
+					Host: azapp.Spec.Networking.Url,
 					IngressRuleValue: networkingv1.IngressRuleValue{
 						HTTP: &networkingv1.HTTPIngressRuleValue{
 							Paths: []networkingv1.HTTPIngressPath{
@@ -105,7 +243,7 @@ func (r *AzureAppReconciler) desiredIngress(azapp *k8sappv0alpha1.AzureApp) (net
 									Backend: networkingv1.IngressBackend{
 										Service: &networkingv1.IngressServiceBackend{
 											Name: azapp.Spec.Identifier,
-											Port: networkingv1.ServiceBackendPort{Number: azapp.Spec.ServingPort},
+											Port: networkingv1.ServiceBackendPort{Number: azapp.Spec.Networking.ServingPort},
 										},
 									},
 								},
@@ -117,6 +255,15 @@ func (r *AzureAppReconciler) desiredIngress(azapp *k8sappv0alpha1.AzureApp) (net
 		},
 	}
 
+	if !azapp.Spec.TLS.Disabled {
+		ing.Spec.TLS = []networkingv1.IngressTLS{
+			{
+				Hosts:      []string{azapp.Spec.Networking.Url},
+				SecretName: tlsSecretName(azapp),
+			},
+		}
+	}
+
 	if err := ctrl.SetControllerReference(azapp, &ing, r.Scheme); err != nil {
 		return ing, err
 	}
@@ -124,7 +271,7 @@ func (r *AzureAppReconciler) desiredIngress(azapp *k8sappv0alpha1.AzureApp) (net
 	return ing, nil
 }
 
-func (r *AzureAppReconciler) desiredService(azapp *k8sappv0alpha1.AzureApp) (corev1.Service, error) {
+func (r *AzureAppReconciler) desiredService(azapp *k8sappv1alpha1.AzureApp) (corev1.Service, error) {
 	svc := corev1.Service{
 		TypeMeta: metav1.TypeMeta{APIVersion: corev1.SchemeGroupVersion.String(), Kind: "Service"},
 		ObjectMeta: metav1.ObjectMeta{
@@ -134,7 +281,7 @@ func (r *AzureAppReconciler) desiredService(azapp *k8sappv0alpha1.AzureApp) (cor
 		},
 		Spec: corev1.ServiceSpec{
 			Ports: []corev1.ServicePort{
-				{Name: "http", Port: azapp.Spec.ServingPort, Protocol: "TCP", TargetPort: intstr.FromInt(int(azapp.Spec.ServingPort))},
+				{Name: "http", Port: azapp.Spec.Networking.ServingPort, Protocol: "TCP", TargetPort: intstr.FromInt(int(azapp.Spec.Networking.ServingPort))},
 			},
 			Selector: map[string]string{"azureapp": azapp.Spec.Identifier},
 			Type:     corev1.ServiceTypeNodePort,
@@ -149,7 +296,7 @@ func (r *AzureAppReconciler) desiredService(azapp *k8sappv0alpha1.AzureApp) (cor
 	return svc, nil
 }
 
-func (r *AzureAppReconciler) desiredSecret(azappCred map[string]string, azapp *k8sappv0alpha1.AzureApp) (corev1.Secret, error) {
+func (r *AzureAppReconciler) desiredSecret(azappCred map[string]string, azapp *k8sappv1alpha1.AzureApp) (corev1.Secret, error) {
 	secretMap := make(map[string]string)
 	secretMap["AZURE_APP_ID"] = azappCred["appId"]
 	secretMap["AZURE_APP_SECRET"] = azappCred["appSecret"]
@@ -171,9 +318,138 @@ func (r *AzureAppReconciler) desiredSecret(azappCred map[string]string, azapp *k
 	return secret, nil
 }
 
-func (r *AzureAppReconciler) buildKubeObjects(ctx context.Context, azapp k8sappv0alpha1.AzureApp) ([]client.Object, error) {
+// databaseSecretName is the name of the secret holding the app database connection details
+func databaseSecretName(azapp *k8sappv1alpha1.AzureApp) string {
+	return fmt.Sprintf("%s-database", azapp.Spec.Identifier)
+}
+
+// desiredDatabaseSecret holds the app database server, name and connection string under the spec.database.envVars
+// names, the connection string signs in with the app credential from terraform
+func (r *AzureAppReconciler) desiredDatabaseSecret(azappCred map[string]string, azapp *k8sappv1alpha1.AzureApp) (corev1.Secret, error) {
+	dbEnvVars := azapp.Spec.Database.EnvVars.WithDefaults()
+	secret := corev1.Secret{
+		TypeMeta: metav1.TypeMeta{APIVersion: corev1.SchemeGroupVersion.String(), Kind: "Secret"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      databaseSecretName(azapp),
+			Namespace: azapp.Namespace,
+			Labels:    map[string]string{"azureapp": azapp.Spec.Identifier},
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: map[string][]byte{
+			dbEnvVars.Server:           []byte(dependencies.DatabaseServer()),
+			dbEnvVars.Name:             []byte(dependencies.DatabaseName(azapp)),
+			dbEnvVars.ConnectionString: []byte(dependencies.DatabaseConnectionString(azapp, azappCred["appId"], azappCred["appSecret"])),
+		},
+	}
+
+	if err := ctrl.SetControllerReference(azapp, &secret, r.Scheme); err != nil {
+		return secret, err
+	}
+
+	return secret, nil
+}
+
+// desiredTLSSecret holds the Key Vault certificate served by the app ingress
+func (r *AzureAppReconciler) desiredTLSSecret(cert *az.TlsCertificate, azapp *k8sappv1alpha1.AzureApp) (corev1.Secret, error) {
+	secret := corev1.Secret{
+		TypeMeta: metav1.TypeMeta{APIVersion: corev1.SchemeGroupVersion.String(), Kind: "Secret"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        tlsSecretName(azapp),
+			Namespace:   azapp.Namespace,
+			Labels:      map[string]string{"azureapp": azapp.Spec.Identifier},
+			Annotations: map[string]string{certificateVersionAnnotation: cert.Version},
+		},
+		Type: corev1.SecretTypeTLS,
+		Data: map[string][]byte{
+			corev1.TLSCertKey:       cert.Cert,
+			corev1.TLSPrivateKeyKey: cert.Key,
+		},
+	}
+
+	if err := ctrl.SetControllerReference(azapp, &secret, r.Scheme); err != nil {
+		return secret, err
+	}
+
+	return secret, nil
+}
+
+// keyVaultSecretsName is the name of the secret holding the app spec.keyVaultSecrets values
+func keyVaultSecretsName(azapp *k8sappv1alpha1.AzureApp) string {
+	return fmt.Sprintf("%s-keyvault", azapp.Spec.Identifier)
+}
+
+// keyVaultSecretsHash identifies the key vault secret versions projected into the app and where they go, values
+// are left out so the hash can be shown on the pod template
+func keyVaultSecretsHash(azapp *k8sappv1alpha1.AzureApp, secrets []az.Secret) string {
+	h := sha256.New()
+	for i, kvSecret := range azapp.Spec.KeyVaultSecrets {
+		fmt.Fprintf(h, "%s/%s env=%s file=%s\n", kvSecret.Name, secrets[i].Version, kvSecret.EnvVar, kvSecret.FileKey)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// desiredKeyVaultSecret holds the spec.keyVaultSecrets values read from the app key vault, in the order of the
+// spec, under their env var or file key
+func (r *AzureAppReconciler) desiredKeyVaultSecret(secrets []az.Secret, azapp *k8sappv1alpha1.AzureApp) (corev1.Secret, error) {
+	data := make(map[string][]byte, len(secrets))
+	for i, kvSecret := range azapp.Spec.KeyVaultSecrets {
+		key := kvSecret.EnvVar
+		if kvSecret.FileKey != "" {
+			key = kvSecret.FileKey
+		}
+		data[key] = []byte(secrets[i].Value)
+	}
+	secret := corev1.Secret{
+		TypeMeta: metav1.TypeMeta{APIVersion: corev1.SchemeGroupVersion.String(), Kind: "Secret"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        keyVaultSecretsName(azapp),
+			Namespace:   azapp.Namespace,
+			Labels:      map[string]string{"azureapp": azapp.Spec.Identifier},
+			Annotations: map[string]string{keyVaultSecretsHashAnnotation: keyVaultSecretsHash(azapp, secrets)},
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: data,
+	}
+
+	if err := ctrl.SetControllerReference(azapp, &secret, r.Scheme); err != nil {
+		return secret, err
+	}
+
+	return secret, nil
+}
+
+// keyVaultSecretsStatus is the status of the key vault secrets synced into the app, nil when it has none
+func keyVaultSecretsStatus(azapp *k8sappv1alpha1.AzureApp, secrets []az.Secret) []k8sappv1alpha1.KeyVaultSecretStatus {
+	var status []k8sappv1alpha1.KeyVaultSecretStatus
+	for i, kvSecret := range azapp.Spec.KeyVaultSecrets {
+		status = append(status, k8sappv1alpha1.KeyVaultSecretStatus{Name: kvSecret.Name, Version: secrets[i].Version})
+	}
+	return status
+}
+
+// certificateMessage is the CertificateReady message for a certificate synced into the app tls secret, it carries
+// the version so a new one in key vault is noticed as an update
+func certificateMessage(cert *az.TlsCertificate, azapp *k8sappv1alpha1.AzureApp) string {
+	return fmt.Sprintf("Found tls certificate %s version %s in the app key vault, synced to secret %s",
+		dependencies.CertificateName(azapp), cert.Version, tlsSecretName(azapp))
+}
+
+// certificateStatus is the status of a certificate synced into the app tls secret, nil when tls is disabled
+func certificateStatus(cert *az.TlsCertificate) *k8sappv1alpha1.CertificateStatus {
+	if cert == nil {
+		return nil
+	}
+	status := &k8sappv1alpha1.CertificateStatus{Version: cert.Version}
+	if cert.NotAfter != nil {
+		notAfter := metav1.NewTime(*cert.NotAfter)
+		status.NotAfter = &notAfter
+	}
+	return status
+}
+
+func (r *AzureAppReconciler) buildKubeObjects(ctx context.Context, azapp k8sappv1alpha1.AzureApp, tfclient *dependencies.TfDependenciesClient, cert *az.TlsCertificate, kvSecrets []az.Secret) ([]client.Object, error) {
 	azappk8s := kubeobjects.AzAppKubeObjects
-	appCredential, err := dependencies.GetTerraformAppCredentialOutput(ctx, &azapp)
+	appCredential, err := tfclient.GetTerraformAppCredentialOutput(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -182,7 +458,24 @@ func (r *AzureAppReconciler) buildKubeObjects(ctx context.Context, azapp k8sappv
 	if err != nil {
 		return nil, err
 	}
-	deployment, err := r.desiredDeployment(&azapp, secret)
+	azappk8s = append(azappk8s, &secret)
+	if azapp.Spec.Database.Enabled {
+		dbSecret, err := r.desiredDatabaseSecret(appCredential, &azapp)
+		if err != nil {
+			return nil, err
+		}
+		azappk8s = append(azappk8s, &dbSecret)
+	}
+	var kvSecret *corev1.Secret
+	if len(azapp.Spec.KeyVaultSecrets) > 0 {
+		desired, err := r.desiredKeyVaultSecret(kvSecrets, &azapp)
+		if err != nil {
+			return nil, err
+		}
+		kvSecret = &desired
+		azappk8s = append(azappk8s, kvSecret)
+	}
+	deployment, err := r.desiredDeployment(&azapp, secret, kvSecret)
 	if err != nil {
 		return nil, err
 	}
@@ -190,14 +483,23 @@ func (r *AzureAppReconciler) buildKubeObjects(ctx context.Context, azapp k8sappv
 	if err != nil {
 		return nil, err
 	}
+	azappk8s = append(azappk8s, &deployment, &service)
+	// cert is nil when tls is disabled
+	if cert != nil {
+		tlsSecret, err := r.desiredTLSSecret(cert, &azapp)
+		if err != nil {
+			return nil, err
+		}
+		azappk8s = append(azappk8s, &tlsSecret)
+	}
 	ingress, err := r.desiredIngress(&azapp)
 	if err != nil {
 		return nil, err
 	}
-	return append(azappk8s, &secret, &deployment, &service, &ingress), nil
+	return append(azappk8s, &ingress), nil
 }
 
-func (r *AzureAppReconciler) SetupFinalizer(finalizerName string, azapp *k8sappv0alpha1.AzureApp) error {
+func (r *AzureAppReconciler) SetupFinalizer(finalizerName string, azapp *k8sappv1alpha1.AzureApp) error {
 	if !controllerutil.ContainsFinalizer(azapp, finalizerName) {
 		controllerutil.AddFinalizer(azapp, finalizerName)
 		if err := r.Update(context.Background(), azapp); err != nil {
@@ -207,7 +509,7 @@ func (r *AzureAppReconciler) SetupFinalizer(finalizerName string, azapp *k8sappv
 	return nil
 }
 
-func (r *AzureAppReconciler) RemoveFinalizer(finalizerName string, azapp *k8sappv0alpha1.AzureApp) error {
+func (r *AzureAppReconciler) RemoveFinalizer(finalizerName string, azapp *k8sappv1alpha1.AzureApp) error {
 	controllerutil.RemoveFinalizer(azapp, finalizerName)
 	if err := r.Update(context.Background(), azapp); err != nil {
 		return err
@@ -215,27 +517,101 @@ func (r *AzureAppReconciler) RemoveFinalizer(finalizerName string, azapp *k8sapp
 	return nil
 }
 
-func (r *AzureAppReconciler) ManageFinalizer(ctx context.Context, azapp k8sappv0alpha1.AzureApp, tfclient *dependencies.TfDependenciesClient) (bool, error) {
+// ManageFinalizer runs the app deletion policy once it's being deleted, newTfClient is only called by the policies
+// that run terraform
+func (r *AzureAppReconciler) ManageFinalizer(ctx context.Context, azapp k8sappv1alpha1.AzureApp, newTfClient func() (*dependencies.TfDependenciesClient, error)) (bool, error) {
 	logr := logr.FromContextOrDiscard(ctx)
 	finalizer := "DestroyAzureResources"
-	r.SetupFinalizer(finalizer, &azapp)
+	if err := r.SetupFinalizer(finalizer, &azapp); err != nil {
+		// azure resources must not be created before the finalizer that destroys them is in place
+		return false, err
+	}
 	if !azapp.ObjectMeta.DeletionTimestamp.IsZero() {
-		logr.Info("Removing Azure Resources")
-		if err := r.kubeclient.SetProvisionState("Removing Azure resources", &azapp); err != nil {
-			return false, err
-		}
-		if err := tfclient.ManageTerraformableExternalDependencies(ctx, &azapp, "destroy", ""); err != nil {
-			return false, err
+		switch azapp.Spec.DeletionPolicy {
+		case k8sappv1alpha1.DeletionRetain:
+			r.dropDatabaseUser(ctx, &azapp)
+			logr.Info(fmt.Sprintf("Retaining Azure Resources and terraform state of app: %s", azapp.Name))
+			r.Recorder.Event(&azapp, corev1.EventTypeNormal, "Retained", "Azure resources and terraform state were kept, deletion policy is Retain")
+		case k8sappv1alpha1.DeletionOrphan:
+			r.dropDatabaseUser(ctx, &azapp)
+			tfclient, err := newTfClient()
+			if err != nil {
+				return false, err
+			}
+			logr.Info(fmt.Sprintf("Archiving terraform state of app: %s", azapp.Name))
+			tombstone, err := tfclient.ArchiveTerraformState(ctx, &azapp)
+			if err != nil {
+				return false, r.markFailed(ctx, &azapp, k8sappv1alpha1.ConditionAzureResourcesReady, "ArchiveStateFailed", err)
+			}
+			message := "Azure resources were kept, there was no terraform state to archive"
+			if tombstone != "" {
+				message = fmt.Sprintf("Azure resources were kept and the terraform state archived at %s", tombstone)
+			}
+			r.Recorder.Event(&azapp, corev1.EventTypeNormal, "Orphaned", message)
+		default:
+			tfclient, err := newTfClient()
+			if err != nil {
+				return false, err
+			}
+			if err := r.destroyAzureResources(ctx, &azapp, tfclient); err != nil {
+				return false, err
+			}
 		}
 		if err := r.RemoveFinalizer(finalizer, &azapp); err != nil {
 			return false, err
 		}
-		logr.Info(fmt.Sprintf("Done deleting Azure Resources for app: %s", azapp.Name))
+		metrics.ForgetApp(azapp.Name, azapp.Namespace)
 		return true, nil
 	}
 	return false, nil
 }
 
+// dropAppDatabaseUser drops the database user of an app, tests replace it to run without a database
+var dropAppDatabaseUser = dependencies.DropDatabaseUser
+
+// dropDatabaseUser drops the app database user when its database is kept after the app is deleted, terraform
+// destroy removes the user along with the database otherwise. A database that can't be reached, or that's
+// already gone, doesn't hold the deletion: the failure is recorded and the user is left behind for the orphaned
+// user scan to report.
+func (r *AzureAppReconciler) dropDatabaseUser(ctx context.Context, azapp *k8sappv1alpha1.AzureApp) {
+	logr := logr.FromContextOrDiscard(ctx)
+	if !azapp.Spec.Database.Enabled {
+		return
+	}
+	user := dependencies.DatabaseUser(azapp)
+	logr.Info(fmt.Sprintf("Dropping database user %s of app: %s", user, azapp.Name))
+	if err := dropAppDatabaseUser(ctx, azapp); err != nil {
+		logr.Error(err, fmt.Sprintf("Unable to drop database user %s of app: %s", user, azapp.Name))
+		r.Recorder.Event(azapp, corev1.EventTypeWarning, "DropUserFailed",
+			fmt.Sprintf("Database user %s could not be dropped and is left in database %s: %s", user, dependencies.DatabaseName(azapp), err))
+		return
+	}
+	r.Recorder.Event(azapp, corev1.EventTypeNormal, "DatabaseUserDropped",
+		fmt.Sprintf("Database user %s was dropped, database %s is kept", user, dependencies.DatabaseName(azapp)))
+}
+
+func (r *AzureAppReconciler) destroyAzureResources(ctx context.Context, azapp *k8sappv1alpha1.AzureApp, tfclient *dependencies.TfDependenciesClient) error {
+	logr := logr.FromContextOrDiscard(ctx)
+	logr.Info("Removing Azure Resources")
+	r.Recorder.Event(azapp, corev1.EventTypeNormal, "Destroying", "Running terraform destroy")
+	if err := r.kubeclient.SetConditions(azapp,
+		newCondition(k8sappv1alpha1.ConditionReady, metav1.ConditionFalse, "Deleting", "Removing Azure resources"),
+	); err != nil {
+		return err
+	}
+	if err := r.kubeclient.SetProvisionState("Removing Azure resources", azapp); err != nil {
+		return err
+	}
+	start := time.Now()
+	if err := tfclient.ManageTerraformableExternalDependencies(ctx, azapp, "destroy", ""); err != nil {
+		err = fmt.Errorf("error destroying terraform dependencies: %w", err)
+		return r.markFailed(ctx, azapp, k8sappv1alpha1.ConditionAzureResourcesReady, "DestroyFailed", err)
+	}
+	logr.Info(fmt.Sprintf("Done deleting Azure Resources for app: %s", azapp.Name))
+	r.Recorder.Event(azapp, corev1.EventTypeNormal, "Destroyed", fmt.Sprintf("Terraform destroy finished in %v and the state was deleted", time.Since(start).Round(time.Second)))
+	return nil
+}
+
 func ignoreConflict(ctx context.Context, err error) error {
 	logr := logr.FromContextOrDiscard(ctx)
 	if k8serr.IsConflict(err) {
@@ -244,3 +620,188 @@ func ignoreConflict(ctx context.Context, err error) error {
 	}
 	return err
 }
+
+// suspended reports if the app reconcile is suspended by spec.suspend or the paused annotation
+func suspended(azapp *k8sappv1alpha1.AzureApp) bool {
+	return azapp.Spec.Suspend || azapp.Annotations[k8sappv1alpha1.PausedAnnotation] == "true"
+}
+
+// suspendTransition returns the Suspended condition of an app that is suspended or being resumed, nil otherwise,
+// and whether the app is going through that transition now, so its event is only recorded once
+func suspendTransition(azapp *k8sappv1alpha1.AzureApp) (*metav1.Condition, bool) {
+	wasSuspended := meta.IsStatusConditionTrue(azapp.Status.Conditions, k8sappv1alpha1.ConditionSuspended)
+	if suspended(azapp) {
+		condition := newCondition(k8sappv1alpha1.ConditionSuspended, metav1.ConditionTrue, "Suspended", "Reconcile is suspended by spec.suspend or the paused annotation")
+		return &condition, !wasSuspended
+	}
+	if wasSuspended {
+		condition := newCondition(k8sappv1alpha1.ConditionSuspended, metav1.ConditionFalse, "Resumed", "Reconcile was resumed")
+		return &condition, true
+	}
+	return nil, false
+}
+
+// terraformUpToDate reports if terraform already planned the current inputs successfully and drift
+// detection is not due yet, in which case init and plan can be skipped
+func terraformUpToDate(azapp *k8sappv1alpha1.AzureApp, inputsHash string) bool {
+	if azapp.Status.SpecHash != inputsHash || azapp.Status.LastPlanTime == nil {
+		return false
+	}
+	return time.Since(azapp.Status.LastPlanTime.Time) < driftDetectionInterval(azapp)
+}
+
+// approvalPending reports if the last plan was made for the current inputs and is still waiting for the approval
+// annotation to match its hash. It isn't planned again until approved or until drift detection is due, when it's
+// refreshed.
+func approvalPending(azapp *k8sappv1alpha1.AzureApp, inputsHash string) bool {
+	plan := azapp.Status.LastPlan
+	if plan == nil || plan.InputsHash != inputsHash || !conditionHasReason(azapp, k8sappv1alpha1.ConditionTerraformPlanned, "AwaitingApproval") {
+		return false
+	}
+	if azapp.Annotations[k8sappv1alpha1.ApprovedPlanAnnotation] == plan.Hash {
+		return false
+	}
+	return time.Since(plan.Time.Time) < driftDetectionInterval(azapp)
+}
+
+// nextDriftCheck returns how long until terraform should plan again to detect drift
+func nextDriftCheck(azapp *k8sappv1alpha1.AzureApp) time.Duration {
+	interval := driftDetectionInterval(azapp)
+	if azapp.Status.LastPlanTime == nil {
+		return interval
+	}
+	if next := interval - time.Since(azapp.Status.LastPlanTime.Time); next > 0 {
+		return next
+	}
+	return time.Second
+}
+
+// certificateWaitInitialInterval is the delay before the first certificate check after the app started waiting
+const certificateWaitInitialInterval = 30 * time.Second
+
+// certificateWait is how long the app has been waiting on its certificate, from when CertificateReady became
+// False, so the wait survives operator restarts. It's zero for an app that isn't waiting yet.
+func certificateWait(azapp *k8sappv1alpha1.AzureApp) time.Duration {
+	condition := meta.FindStatusCondition(azapp.Status.Conditions, k8sappv1alpha1.ConditionCertificateReady)
+	if condition == nil || condition.Status != metav1.ConditionFalse {
+		return 0
+	}
+	return time.Since(condition.LastTransitionTime.Time)
+}
+
+// certificateBackoff is the delay before the next certificate check of an app that has been waiting for wait.
+// Each check waits as long as the app already waited, so the interval doubles from certificateWaitInitialInterval
+// up to maxInterval.
+func certificateBackoff(wait, maxInterval time.Duration) time.Duration {
+	if wait < certificateWaitInitialInterval {
+		wait = certificateWaitInitialInterval
+	}
+	if wait > maxInterval {
+		return maxInterval
+	}
+	return wait
+}
+
+// driftDetectionInterval returns the spec interval, falling back to the resync period annotation and then
+// to the operator wide interval
+func driftDetectionInterval(azapp *k8sappv1alpha1.AzureApp) time.Duration {
+	if dd := azapp.Spec.DriftDetection; dd != nil && dd.Interval != nil && dd.Interval.Duration > 0 {
+		return dd.Interval.Duration
+	}
+	if period, ok := azapp.Annotations[k8sappv1alpha1.ResyncPeriodAnnotation]; ok {
+		if interval, err := time.ParseDuration(period); err == nil && interval > 0 {
+			return interval
+		}
+	}
+	return config.Config.DriftDetectionInterval
+}
+
+func driftDetectionMode(azapp *k8sappv1alpha1.AzureApp) k8sappv1alpha1.DriftDetectionMode {
+	if azapp.Spec.DriftDetection == nil || azapp.Spec.DriftDetection.Mode == "" {
+		return k8sappv1alpha1.DriftRemediate
+	}
+	return azapp.Spec.DriftDetection.Mode
+}
+
+// planApproved reports if the plan can be applied under the app approval policy, gated plans need the
+// approval annotation to match their hash
+func planApproved(azapp *k8sappv1alpha1.AzureApp, plan *k8sappv1alpha1.PlanSummary) bool {
+	switch azapp.Spec.Approval {
+	case k8sappv1alpha1.ApprovalManual:
+	case k8sappv1alpha1.ApprovalManualOnDestroy:
+		if plan.Destroy == 0 {
+			return true
+		}
+	default:
+		return true
+	}
+	return azapp.Annotations[k8sappv1alpha1.ApprovedPlanAnnotation] == plan.Hash
+}
+
+func driftSummary(plan *k8sappv1alpha1.PlanSummary) string {
+	return fmt.Sprintf("%d resources changed outside terraform: %s", len(plan.Resources), listPlannedResources(plan))
+}
+
+func planMessage(plan *k8sappv1alpha1.PlanSummary) string {
+	return fmt.Sprintf("Plan: %d to add, %d to change, %d to destroy: %s", plan.Add, plan.Change, plan.Destroy, listPlannedResources(plan))
+}
+
+// listPlannedResources lists the planned resource addresses with their action, capped so it fits events
+// and condition messages
+func listPlannedResources(plan *k8sappv1alpha1.PlanSummary) string {
+	const maxListed = 10
+	var listed []string
+	for i, resource := range plan.Resources {
+		if i == maxListed {
+			listed = append(listed, fmt.Sprintf("and %d more", len(plan.Resources)-maxListed))
+			break
+		}
+		listed = append(listed, fmt.Sprintf("%s (%s)", resource.Address, resource.Action))
+	}
+	return strings.Join(listed, ", ")
+}
+
+func newCondition(condType string, status metav1.ConditionStatus, reason, message string) metav1.Condition {
+	return metav1.Condition{Type: condType, Status: status, Reason: reason, Message: message}
+}
+
+// databaseUserCondition is the DatabaseUserReady condition of the database access in dbStatus, nil for apps
+// without a database. A user that fell back to db_owner has the DefaultDatabaseRole reason.
+func databaseUserCondition(azapp *k8sappv1alpha1.AzureApp, dbStatus *k8sappv1alpha1.DatabaseStatus) metav1.Condition {
+	if dbStatus == nil {
+		return newCondition(k8sappv1alpha1.ConditionDatabaseUserReady, metav1.ConditionTrue, "DatabaseDisabled", "App has no database")
+	}
+	access := append(append([]string{}, dbStatus.Roles...), dbStatus.SchemaPermissions...)
+	message := fmt.Sprintf("Database user %s is set up without roles or schema permissions", dbStatus.User)
+	if len(access) > 0 {
+		message = fmt.Sprintf("Database user %s is set up with %s", dbStatus.User, strings.Join(access, ", "))
+	}
+	if dependencies.UsesDefaultDatabaseRole(azapp) {
+		return newCondition(k8sappv1alpha1.ConditionDatabaseUserReady, metav1.ConditionTrue, "DefaultDatabaseRole",
+			fmt.Sprintf("Database user %s is a member of %s because spec.database sets neither roles nor schemaGrants, list the roles the app needs",
+				dbStatus.User, k8sappv1alpha1.DefaultDatabaseRole))
+	}
+	return newCondition(k8sappv1alpha1.ConditionDatabaseUserReady, metav1.ConditionTrue, "UserReady", message)
+}
+
+// conditionHasReason reports if the app already has the condition with that reason, so events are only
+// recorded when a phase changes instead of on every reconcile
+func conditionHasReason(azapp *k8sappv1alpha1.AzureApp, condType, reason string) bool {
+	cond := meta.FindStatusCondition(azapp.Status.Conditions, condType)
+	return cond != nil && cond.Reason == reason
+}
+
+// markFailed records a Warning event and sets the failing phase condition and Ready to false with the error
+// message, then returns the error so the reconcile gets requeued. Failing to update status is only logged,
+// the phase error is the relevant one.
+func (r *AzureAppReconciler) markFailed(ctx context.Context, azapp *k8sappv1alpha1.AzureApp, condType, reason string, err error) error {
+	logr := logr.FromContextOrDiscard(ctx)
+	r.Recorder.Event(azapp, corev1.EventTypeWarning, reason, err.Error())
+	if serr := r.kubeclient.SetConditions(azapp,
+		newCondition(condType, metav1.ConditionFalse, reason, err.Error()),
+		newCondition(k8sappv1alpha1.ConditionReady, metav1.ConditionFalse, reason, err.Error()),
+	); serr != nil {
+		logr.Info(fmt.Sprintf("Unable to set failed conditions for app [%s]: %s", azapp.Name, serr))
+	}
+	return err
+}
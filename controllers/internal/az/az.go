@@ -2,35 +2,296 @@ package az
 
 import (
 	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"net/http"
+	"sort"
+	"time"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
 	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
 	"github.com/Azure/azure-sdk-for-go/sdk/keyvault/azcertificates"
+	"github.com/Azure/azure-sdk-for-go/sdk/keyvault/azsecrets"
 	"github.com/rdalbuquerque/azure-operator/operator/controllers/config"
+	"github.com/rdalbuquerque/azure-operator/operator/controllers/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/crypto/pkcs12"
 )
 
+// TlsCertificate is a version of a Key Vault certificate with its private key, both PEM encoded
+type TlsCertificate struct {
+	// Version is the Key Vault certificate version the material was read from
+	Version string
+	// Cert is the certificate chain, leaf first
+	Cert []byte
+	// Key is the certificate private key
+	Key []byte
+	// NotAfter is when the certificate expires
+	NotAfter *time.Time
+}
+
+// Secret is a version of a Key Vault secret
+type Secret struct {
+	// Version is the Key Vault secret version the value was read from
+	Version string
+	// Value of the secret
+	Value string
+}
+
 type AzClient struct {
 	cred *azidentity.ClientSecretCredential
 }
 
 func NewAzureClient() (*AzClient, error) {
-	azcred, err := azidentity.NewClientSecretCredential(config.Config.ARMTenantID, config.Config.ARMClientID, config.Config.ARMClientSecret, nil)
+	azcred, err := azidentity.NewClientSecretCredential(config.Config.ARMTenantID, config.Config.ARMClientID, config.Config.ARMClientSecret,
+		&azidentity.ClientSecretCredentialOptions{ClientOptions: tracing.ClientOptions()})
 	if err != nil {
 		return nil, err
 	}
 	return &AzClient{cred: azcred}, nil
 }
 
-func (az *AzClient) TlsCertificateExists(azkeyvault string) (bool, error) {
+// GetTlsCertificate reads the current version of the certificate name in azkeyvault along with its private key,
+// which Key Vault only serves through the secret backing the certificate. It returns nil when the certificate
+// doesn't exist yet or its first version is still being issued.
+func (az *AzClient) GetTlsCertificate(ctx context.Context, azkeyvault, name string) (*TlsCertificate, error) {
+	kvUrl := fmt.Sprintf("https://%s.vault.azure.net/", azkeyvault)
+	certClient, err := azcertificates.NewClient(kvUrl, az.cred, &azcertificates.ClientOptions{ClientOptions: tracing.ClientOptions()})
+	if err != nil {
+		return nil, err
+	}
+	certCtx, span := tracing.Start(ctx, "keyvault GetCertificate",
+		attribute.String("keyvault.name", azkeyvault),
+		attribute.String("keyvault.certificate", name),
+	)
+	getResp, err := certClient.GetCertificate(certCtx, name, "", nil)
+	err = IgnoreNotFound(err)
+	span.SetAttributes(attribute.Bool("keyvault.certificate.found", getResp.ID != nil))
+	tracing.End(span, err)
+	if err != nil || getResp.ID == nil || getResp.CER == nil {
+		return nil, err
+	}
+	cert := &TlsCertificate{Version: getResp.ID.Version()}
+	if getResp.Attributes != nil {
+		cert.NotAfter = getResp.Attributes.Expires
+	}
+
+	secretClient, err := azsecrets.NewClient(kvUrl, az.cred, &azsecrets.ClientOptions{ClientOptions: tracing.ClientOptions()})
+	if err != nil {
+		return nil, err
+	}
+	secretCtx, span := tracing.Start(ctx, "keyvault GetSecret",
+		attribute.String("keyvault.name", azkeyvault),
+		attribute.String("keyvault.secret", name),
+	)
+	// the backing secret has the same name and version as the certificate
+	secretResp, err := secretClient.GetSecret(secretCtx, name, cert.Version, nil)
+	tracing.End(span, err)
+	if err != nil {
+		return nil, err
+	}
+	if secretResp.Value == nil {
+		return nil, fmt.Errorf("secret backing certificate %s in key vault %s has no value", name, azkeyvault)
+	}
+	contentType := ""
+	if secretResp.ContentType != nil {
+		contentType = *secretResp.ContentType
+	}
+	cert.Cert, cert.Key, err = decodeCertificateSecret(contentType, *secretResp.Value)
+	if err != nil {
+		return nil, fmt.Errorf("decoding certificate %s in key vault %s: %w", name, azkeyvault, err)
+	}
+	return cert, nil
+}
+
+// GetSecret reads the secret name in azkeyvault, at version or at its current version when version is empty
+func (az *AzClient) GetSecret(ctx context.Context, azkeyvault, name, version string) (*Secret, error) {
+	kvUrl := fmt.Sprintf("https://%s.vault.azure.net/", azkeyvault)
+	secretClient, err := azsecrets.NewClient(kvUrl, az.cred, &azsecrets.ClientOptions{ClientOptions: tracing.ClientOptions()})
+	if err != nil {
+		return nil, err
+	}
+	ctx, span := tracing.Start(ctx, "keyvault GetSecret",
+		attribute.String("keyvault.name", azkeyvault),
+		attribute.String("keyvault.secret", name),
+	)
+	resp, err := secretClient.GetSecret(ctx, name, version, nil)
+	tracing.End(span, err)
+	if err != nil {
+		return nil, fmt.Errorf("reading secret %s from key vault %s: %w", name, azkeyvault, err)
+	}
+	if resp.ID == nil || resp.Value == nil {
+		return nil, fmt.Errorf("secret %s in key vault %s has no value", name, azkeyvault)
+	}
+	return &Secret{Version: resp.ID.Version(), Value: *resp.Value}, nil
+}
+
+// SelfSignedIssuer is the Key Vault issuer name of self-signed certificates
+const SelfSignedIssuer = "Self"
+
+// CertificateRequest is a certificate the operator creates in a key vault
+type CertificateRequest struct {
+	// Name of the Key Vault certificate
+	Name string
+	// Issuer is the name of a certificate issuer registered in the key vault, or SelfSignedIssuer
+	Issuer string
+	// CertificateType is the type of certificate requested from the issuer, empty for its default
+	CertificateType string
+	// Host is the certificate subject common name and only DNS name
+	Host string
+	// ValidityInMonths of each certificate version
+	ValidityInMonths int32
+}
+
+// ErrCertificateRequestFailed is returned while the last creation of a certificate failed, Key Vault keeps the
+// failed operation until the certificate pending operation is deleted
+var ErrCertificateRequestFailed = errors.New("certificate request failed")
+
+// RequestTlsCertificate creates the certificate of req in azkeyvault unless its creation is already in progress.
+// Key Vault renews it from the same policy before it expires. The certificate exists once the issuer fulfills
+// the request, which is immediate for self-signed certificates.
+func (az *AzClient) RequestTlsCertificate(ctx context.Context, azkeyvault string, req CertificateRequest) error {
 	kvUrl := fmt.Sprintf("https://%s.vault.azure.net/", azkeyvault)
-	certClient, err := azcertificates.NewClient(kvUrl, az.cred, nil)
+	certClient, err := azcertificates.NewClient(kvUrl, az.cred, &azcertificates.ClientOptions{ClientOptions: tracing.ClientOptions()})
 	if err != nil {
-		return false, err
+		return err
+	}
+	ctx, span := tracing.Start(ctx, "keyvault CreateCertificate",
+		attribute.String("keyvault.name", azkeyvault),
+		attribute.String("keyvault.certificate", req.Name),
+		attribute.String("keyvault.certificate.issuer", req.Issuer),
+	)
+	err = func() error {
+		opResp, err := certClient.GetCertificateOperation(ctx, req.Name, nil)
+		var responseError *azcore.ResponseError
+		switch {
+		case errors.As(err, &responseError) && responseError.StatusCode == http.StatusNotFound:
+		case err != nil:
+			return err
+		case opResp.Status != nil && *opResp.Status == "inProgress":
+			return nil
+		case opResp.Status != nil && *opResp.Status == "failed":
+			details := ""
+			if opResp.StatusDetails != nil {
+				details = *opResp.StatusDetails
+			} else if opResp.Error != nil {
+				details = opResp.Error.Error()
+			}
+			return fmt.Errorf("%w: %s", ErrCertificateRequestFailed, details)
+		}
+		_, err = certClient.CreateCertificate(ctx, req.Name, azcertificates.CreateCertificateParameters{
+			CertificatePolicy: certificatePolicy(req),
+		}, nil)
+		return err
+	}()
+	tracing.End(span, err)
+	return err
+}
+
+// certificatePolicy is the Key Vault policy of req, an exportable RSA key so the ingress can serve it and a PEM
+// backing secret
+func certificatePolicy(req CertificateRequest) *azcertificates.CertificatePolicy {
+	issuer := &azcertificates.IssuerParameters{Name: to.Ptr(req.Issuer)}
+	if req.CertificateType != "" {
+		issuer.CertificateType = to.Ptr(req.CertificateType)
+	}
+	return &azcertificates.CertificatePolicy{
+		IssuerParameters: issuer,
+		KeyProperties: &azcertificates.KeyProperties{
+			Exportable: to.Ptr(true),
+			KeyType:    to.Ptr(azcertificates.JSONWebKeyTypeRSA),
+			KeySize:    to.Ptr(int32(2048)),
+			ReuseKey:   to.Ptr(false),
+		},
+		SecretProperties: &azcertificates.SecretProperties{ContentType: to.Ptr("application/x-pem-file")},
+		X509CertificateProperties: &azcertificates.X509CertificateProperties{
+			Subject:                 to.Ptr(fmt.Sprintf("CN=%s", req.Host)),
+			SubjectAlternativeNames: &azcertificates.SubjectAlternativeNames{DNSNames: []*string{to.Ptr(req.Host)}},
+			ValidityInMonths:        to.Ptr(req.ValidityInMonths),
+		},
+		LifetimeActions: []*azcertificates.LifetimeAction{
+			{
+				Action:  &azcertificates.Action{ActionType: to.Ptr(azcertificates.CertificatePolicyActionAutoRenew)},
+				Trigger: &azcertificates.Trigger{LifetimePercentage: to.Ptr(int32(80))},
+			},
+		},
+	}
+}
+
+// decodeCertificateSecret splits the value of a secret backing a Key Vault certificate into the PEM encoded
+// certificate chain, leaf first, and private key. Key Vault stores it as PEM or as a base64 PFX without password
+// depending on the certificate content type.
+func decodeCertificateSecret(contentType, value string) ([]byte, []byte, error) {
+	var blocks []*pem.Block
+	switch contentType {
+	case "application/x-pkcs12":
+		pfx, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, nil, err
+		}
+		blocks, err = pkcs12.ToPEM(pfx, "")
+		if err != nil {
+			return nil, nil, err
+		}
+	case "application/x-pem-file":
+		rest := []byte(value)
+		for {
+			var block *pem.Block
+			block, rest = pem.Decode(rest)
+			if block == nil {
+				break
+			}
+			blocks = append(blocks, block)
+		}
+	default:
+		return nil, nil, fmt.Errorf("unsupported certificate content type %q", contentType)
+	}
+
+	var certs []*x509.Certificate
+	var key []byte
+	for _, block := range blocks {
+		switch block.Type {
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, nil, err
+			}
+			certs = append(certs, cert)
+		case "PRIVATE KEY", "RSA PRIVATE KEY", "EC PRIVATE KEY":
+			if key != nil {
+				return nil, nil, errors.New("more than one private key")
+			}
+			key = encodePrivateKey(block)
+		}
+	}
+	if len(certs) == 0 || key == nil {
+		return nil, nil, errors.New("a certificate and its private key are required")
+	}
+	// ingress controllers expect the leaf certificate first
+	sort.SliceStable(certs, func(i, j int) bool { return !certs[i].IsCA && certs[j].IsCA })
+	var chain []byte
+	for _, cert := range certs {
+		chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	return chain, key, nil
+}
+
+// encodePrivateKey encodes a private key block without headers and with the type matching its DER encoding,
+// the blocks of pkcs12.ToPEM are typed PRIVATE KEY even though they hold PKCS#1 or SEC 1 keys
+func encodePrivateKey(block *pem.Block) []byte {
+	keyType := block.Type
+	if _, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		keyType = "PRIVATE KEY"
+	} else if _, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		keyType = "RSA PRIVATE KEY"
+	} else if _, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		keyType = "EC PRIVATE KEY"
 	}
-	getResp, err := certClient.GetCertificate(context.TODO(), "tls", "", nil)
-	return getResp.ID != nil, IgnoreNotFound(err)
+	return pem.EncodeToMemory(&pem.Block{Type: keyType, Bytes: block.Bytes})
 }
 
 func IgnoreNotFound(err error) error {
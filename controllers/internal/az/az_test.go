@@ -0,0 +1,118 @@
+package az
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func newTestCertificate(t *testing.T, cn string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestDecodePemCertificateSecret(t *testing.T) {
+	ca, caKey := newTestCertificate(t, "ca", true, nil, nil)
+	leaf, leafKey := newTestCertificate(t, "app1.local.dev", false, ca, caKey)
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(leafKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// key vault keeps the order the certificate was imported with, the CA may come first
+	value := string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8})) +
+		string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})) +
+		string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf.Raw}))
+
+	chain, key, err := decodeCertificateSecret("application/x-pem-file", value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, rest := pem.Decode(chain)
+	if first == nil || string(first.Bytes) != string(leaf.Raw) {
+		t.Error("leaf certificate is not first in the chain")
+	}
+	if second, _ := pem.Decode(rest); second == nil || string(second.Bytes) != string(ca.Raw) {
+		t.Error("CA certificate is missing from the chain")
+	}
+	keyBlock, _ := pem.Decode(key)
+	if keyBlock == nil || keyBlock.Type != "PRIVATE KEY" || string(keyBlock.Bytes) != string(pkcs8) {
+		t.Errorf("unexpected private key %q", key)
+	}
+}
+
+func TestDecodeCertificateSecretErrors(t *testing.T) {
+	ca, _ := newTestCertificate(t, "ca", true, nil, nil)
+	certOnly := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}))
+	for name, tc := range map[string]struct{ contentType, value string }{
+		"missing key":           {"application/x-pem-file", certOnly},
+		"unsupported type":      {"text/plain", certOnly},
+		"pfx that isn't base64": {"application/x-pkcs12", "not base64!"},
+	} {
+		if _, _, err := decodeCertificateSecret(tc.contentType, tc.value); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestEncodePrivateKeyFixesPfxKeyType(t *testing.T) {
+	_, key := newTestCertificate(t, "app", false, nil, nil)
+	sec1, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// pkcs12.ToPEM types SEC 1 and PKCS#1 keys as PRIVATE KEY
+	block, _ := pem.Decode(encodePrivateKey(&pem.Block{Type: "PRIVATE KEY", Headers: map[string]string{"friendlyName": "tls"}, Bytes: sec1}))
+	if block.Type != "EC PRIVATE KEY" || len(block.Headers) != 0 {
+		t.Errorf("expected an EC PRIVATE KEY block without headers, got %s %v", block.Type, block.Headers)
+	}
+}
+
+func TestCertificatePolicy(t *testing.T) {
+	policy := certificatePolicy(CertificateRequest{Name: "web", Issuer: "digicert", CertificateType: "OV-SSL", Host: "app1.example.com", ValidityInMonths: 6})
+	if *policy.IssuerParameters.Name != "digicert" || *policy.IssuerParameters.CertificateType != "OV-SSL" {
+		t.Errorf("unexpected issuer %+v", policy.IssuerParameters)
+	}
+	x509Props := policy.X509CertificateProperties
+	if *x509Props.Subject != "CN=app1.example.com" || len(x509Props.SubjectAlternativeNames.DNSNames) != 1 ||
+		*x509Props.SubjectAlternativeNames.DNSNames[0] != "app1.example.com" || *x509Props.ValidityInMonths != 6 {
+		t.Errorf("unexpected x509 properties %+v", x509Props)
+	}
+	// the ingress needs the private key and decodeCertificateSecret reads PEM
+	if !*policy.KeyProperties.Exportable || *policy.SecretProperties.ContentType != "application/x-pem-file" {
+		t.Error("certificate key must be exportable as PEM")
+	}
+
+	selfSigned := certificatePolicy(CertificateRequest{Name: "tls", Issuer: SelfSignedIssuer, Host: "app1.example.com", ValidityInMonths: 12})
+	if selfSigned.IssuerParameters.CertificateType != nil {
+		t.Error("self-signed certificates have no certificate type")
+	}
+}
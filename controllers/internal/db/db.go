@@ -4,8 +4,13 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"net/url"
+	"strings"
+	"unicode/utf8"
 
 	"github.com/microsoft/go-mssqldb/azuread"
+	"github.com/rdalbuquerque/azure-operator/operator/controllers/tracing"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type SqlClient struct {
@@ -13,8 +18,25 @@ type SqlClient struct {
 	context context.Context
 }
 
+// ServerHost is the host name of the Azure SQL server sv
+func ServerHost(sv string) string {
+	return fmt.Sprintf("%s.database.windows.net", sv)
+}
+
+// ServicePrincipalConnString is the go-mssqldb connection string to database db of server sv signing in as the
+// Azure AD service principal appid, the secret is escaped so any character can be used
+func ServicePrincipalConnString(appid, appsecret, sv, db string) string {
+	connURL := url.URL{
+		Scheme:   "sqlserver",
+		User:     url.UserPassword(appid, appsecret),
+		Host:     ServerHost(sv),
+		RawQuery: url.Values{"database": {db}, "fedauth": {"ActiveDirectoryServicePrincipal"}}.Encode(),
+	}
+	return connURL.String()
+}
+
 func NewServicePrincipalClient(appid, appsecret, sv, db string, ctx context.Context) (*SqlClient, error) {
-	connString := fmt.Sprintf("sqlserver://%s:%s@%s.database.windows.net?database=%s&fedauth=ActiveDirectoryServicePrincipal", appid, appsecret, sv, db)
+	connString := ServicePrincipalConnString(appid, appsecret, sv, db)
 	dbconn, err := sql.Open(azuread.DriverName, connString)
 	if err != nil {
 		return nil, err
@@ -25,48 +47,249 @@ func NewServicePrincipalClient(appid, appsecret, sv, db string, ctx context.Cont
 	}, nil
 }
 
-func (c *SqlClient) CreateUser(username string) error {
-	var err error
+// maxIdentifierLength is the longest sysname, QUOTENAME returns NULL for longer names
+const maxIdentifierLength = 128
+
+// quoteName quotes name as a T-SQL identifier like QUOTENAME does, with brackets and every ] doubled, so it can
+// be used where a statement takes an identifier and can't take a parameter
+func quoteName(name string) (string, error) {
+	if name == "" || utf8.RuneCountInString(name) > maxIdentifierLength {
+		return "", fmt.Errorf("invalid identifier %q, it must have between 1 and %d characters", name, maxIdentifierLength)
+	}
+	return "[" + strings.ReplaceAll(name, "]", "]]") + "]", nil
+}
 
+// CreateUser creates the contained database user of the Azure AD principal username unless it already exists
+func (c *SqlClient) CreateUser(username string) error {
 	// Check if database is alive.
-	err = c.PingContext(c.context)
-	if err != nil {
+	if err := c.PingContext(c.context); err != nil {
 		return err
 	}
 
+	user, err := quoteName(username)
+	if err != nil {
+		return err
+	}
+	// CREATE USER only takes an identifier, the existence check compares the name as a parameter
 	createUserTsql := fmt.Sprintf(`
-		IF NOT EXISTS(SELECT principal_id FROM sys.database_principals WHERE name = '%s') BEGIN
-			CREATE USER [%s] FROM EXTERNAL PROVIDER;
+		IF NOT EXISTS(SELECT principal_id FROM sys.database_principals WHERE name = @username) BEGIN
+			CREATE USER %s FROM EXTERNAL PROVIDER;
 		END
-	`, username, username)
-	stmt, err := c.Prepare(createUserTsql)
-	if err != nil {
+	`, user)
+	return c.exec(createUserTsql, sql.Named("username", username))
+}
+
+// DropUser drops the contained database user username unless it's already gone
+func (c *SqlClient) DropUser(username string) error {
+	// Check if database is alive.
+	if err := c.PingContext(c.context); err != nil {
 		return err
 	}
-	defer stmt.Close()
-	if _, err := stmt.ExecContext(c.context, username); err != nil {
+
+	user, err := quoteName(username)
+	if err != nil {
 		return err
 	}
+	dropUserTsql := fmt.Sprintf(`
+		IF EXISTS(SELECT principal_id FROM sys.database_principals WHERE name = @username) BEGIN
+			DROP USER %s;
+		END
+	`, user)
+	return c.exec(dropUserTsql, sql.Named("username", username))
+}
 
-	return nil
+// ListExternalUsers lists the database users and groups created FROM EXTERNAL PROVIDER
+func (c *SqlClient) ListExternalUsers() ([]string, error) {
+	rows, err := c.query("SELECT name FROM sys.database_principals WHERE type IN ('E', 'X') ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	users := make([]string, 0, len(rows))
+	for _, row := range rows {
+		users = append(users, row[0])
+	}
+	return users, nil
 }
 
-func (c *SqlClient) GrantOwner(username string) error {
-	// Check if database is alive.
-	err := c.PingContext(c.context)
+// SyncRoles makes username a member of exactly roles, it's added to the missing ones and dropped from the others.
+// Role names are compared case insensitively like SQL Server identifiers.
+func (c *SqlClient) SyncRoles(username string, roles []string) error {
+	user, err := quoteName(username)
 	if err != nil {
 		return err
 	}
+	// every name is checked before the first membership changes
+	quotedRoles := make(map[string]string, len(roles))
+	for _, role := range roles {
+		if quotedRoles[strings.ToLower(role)], err = quoteName(role); err != nil {
+			return err
+		}
+	}
+	rows, err := c.query(`
+		SELECT r.name FROM sys.database_role_members m
+		JOIN sys.database_principals r ON r.principal_id = m.role_principal_id
+		JOIN sys.database_principals u ON u.principal_id = m.member_principal_id
+		WHERE u.name = @username
+	`, sql.Named("username", username))
+	if err != nil {
+		return err
+	}
+	current := make(map[string]bool, len(rows))
+	for _, row := range rows {
+		current[strings.ToLower(row[0])] = true
+	}
+
+	for _, role := range roles {
+		if key := strings.ToLower(role); !current[key] {
+			if err := c.exec(fmt.Sprintf("ALTER ROLE %s ADD MEMBER %s;", quotedRoles[key], user)); err != nil {
+				return err
+			}
+			current[key] = true
+		}
+	}
+	for _, row := range rows {
+		if _, listed := quotedRoles[strings.ToLower(row[0])]; listed {
+			continue
+		}
+		role, err := quoteName(row[0])
+		if err != nil {
+			return err
+		}
+		if err := c.exec(fmt.Sprintf("ALTER ROLE %s DROP MEMBER %s;", role, user)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SchemaPermission is a permission of a database user on a whole schema
+type SchemaPermission struct {
+	Schema     string
+	Permission string
+}
+
+// String formats the permission as it's granted, PERMISSION ON SCHEMA::schema
+func (p SchemaPermission) String() string {
+	return fmt.Sprintf("%s ON SCHEMA::%s", p.Permission, p.Schema)
+}
 
-	grantOwnerTsql := fmt.Sprintf("EXEC sp_addrolemember 'db_owner', [%s];", username)
-	stmt, err := c.Prepare(grantOwnerTsql)
+// key identifies the permission whatever the case of its schema name, SQL Server identifiers are case insensitive
+func (p SchemaPermission) key() SchemaPermission {
+	return SchemaPermission{Schema: strings.ToLower(p.Schema), Permission: p.Permission}
+}
+
+// schemaPermissions are the permissions SyncSchemaPermissions manages, permissions are keywords that can't be
+// quoted so only these are ever formatted into a statement
+var schemaPermissions = map[string]bool{
+	"SELECT": true, "INSERT": true, "UPDATE": true, "DELETE": true, "EXECUTE": true,
+	"REFERENCES": true, "ALTER": true, "CONTROL": true, "VIEW DEFINITION": true,
+}
+
+// SyncSchemaPermissions grants username exactly permissions among the schema permissions it manages, the
+// missing ones are granted and the others revoked
+func (c *SqlClient) SyncSchemaPermissions(username string, permissions []SchemaPermission) error {
+	user, err := quoteName(username)
 	if err != nil {
 		return err
 	}
-	defer stmt.Close()
-	if _, err := stmt.ExecContext(c.context, username); err != nil {
+	desired := make(map[SchemaPermission]bool, len(permissions))
+	for _, p := range permissions {
+		if !schemaPermissions[p.Permission] {
+			return fmt.Errorf("unsupported schema permission %q", p.Permission)
+		}
+		if _, err := quoteName(p.Schema); err != nil {
+			return err
+		}
+		desired[p.key()] = true
+	}
+	rows, err := c.query(`
+		SELECT s.name, p.permission_name FROM sys.database_permissions p
+		JOIN sys.schemas s ON s.schema_id = p.major_id
+		JOIN sys.database_principals u ON u.principal_id = p.grantee_principal_id
+		WHERE p.class = 3 AND p.state IN ('G', 'W') AND u.name = @username
+	`, sql.Named("username", username))
+	if err != nil {
 		return err
 	}
+	current := make(map[SchemaPermission]bool, len(rows))
+	for _, row := range rows {
+		current[SchemaPermission{Schema: row[0], Permission: row[1]}.key()] = true
+	}
 
+	for _, p := range permissions {
+		if !current[p.key()] {
+			schema, _ := quoteName(p.Schema)
+			if err := c.exec(fmt.Sprintf("GRANT %s ON SCHEMA::%s TO %s;", p.Permission, schema, user)); err != nil {
+				return err
+			}
+			current[p.key()] = true
+		}
+	}
+	for _, row := range rows {
+		p := SchemaPermission{Schema: row[0], Permission: row[1]}
+		if desired[p.key()] || !schemaPermissions[p.Permission] {
+			continue
+		}
+		schema, err := quoteName(p.Schema)
+		if err != nil {
+			return err
+		}
+		if err := c.exec(fmt.Sprintf("REVOKE %s ON SCHEMA::%s FROM %s;", p.Permission, schema, user)); err != nil {
+			return err
+		}
+	}
 	return nil
 }
+
+// query runs a query inside its own span and returns its rows with every column read as a string
+func (c *SqlClient) query(query string, args ...any) ([][]string, error) {
+	ctx, span := tracing.Start(c.context, "sql query",
+		attribute.String("db.system", "mssql"),
+		attribute.String("db.statement", query),
+	)
+	var rows [][]string
+	err := func() error {
+		result, err := c.QueryContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		defer result.Close()
+		columns, err := result.Columns()
+		if err != nil {
+			return err
+		}
+		for result.Next() {
+			row := make([]string, len(columns))
+			dest := make([]any, len(columns))
+			for i := range row {
+				dest[i] = &row[i]
+			}
+			if err := result.Scan(dest...); err != nil {
+				return err
+			}
+			rows = append(rows, row)
+		}
+		return result.Err()
+	}()
+	tracing.End(span, err)
+	return rows, err
+}
+
+// exec prepares and runs a statement inside its own span
+func (c *SqlClient) exec(query string, args ...any) error {
+	ctx, span := tracing.Start(c.context, "sql exec",
+		attribute.String("db.system", "mssql"),
+		attribute.String("db.statement", query),
+	)
+	err := func() error {
+		stmt, err := c.PrepareContext(ctx, query)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		_, err = stmt.ExecContext(ctx, args...)
+		return err
+	}()
+	tracing.End(span, err)
+	return err
+}
@@ -4,47 +4,61 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sort"
 	"time"
 
 	"github.com/go-logr/logr"
-	"github.com/hashicorp/terraform-exec/tfexec"
-	k8sappv0alpha1 "github.com/rdalbuquerque/azure-operator/operator/api/v0alpha1"
+	k8sappv1alpha1 "github.com/rdalbuquerque/azure-operator/operator/api/v1alpha1"
 	"github.com/rdalbuquerque/azure-operator/operator/controllers/config"
 	"github.com/rdalbuquerque/azure-operator/operator/controllers/internal/az"
 	"github.com/rdalbuquerque/azure-operator/operator/controllers/internal/db"
+	"github.com/rdalbuquerque/azure-operator/operator/controllers/internal/metrics"
 	"github.com/rdalbuquerque/azure-operator/operator/controllers/internal/tf"
 )
 
+// ErrStalePlan is returned by an apply whose saved plan was discarded because it is out of date
+var ErrStalePlan = tf.ErrStalePlan
+
 type TfDependenciesClient struct {
 	tfc *tf.TfClient
 }
 
-func NewTerraformClient(ctx context.Context, azapp *k8sappv0alpha1.AzureApp) (*TfDependenciesClient, error) {
+func NewTerraformClient(ctx context.Context, azapp *k8sappv1alpha1.AzureApp) (*TfDependenciesClient, error) {
 	tf, err := tf.NewTerraformClient(ctx, config.Config.TerraformExecutablePath, config.Config.TerraformBasePath, azapp)
 	return &TfDependenciesClient{tfc: tf}, err
 }
 
-func (tfd *TfDependenciesClient) CheckTerraformableExternalDependencies(ctx context.Context, azapp *k8sappv0alpha1.AzureApp) (string, bool, error) {
+func (tfd *TfDependenciesClient) CheckTerraformableExternalDependencies(ctx context.Context, azapp *k8sappv1alpha1.AzureApp) (string, bool, error) {
 	logr := logr.FromContextOrDiscard(ctx)
 	planfile := fmt.Sprintf("plan-%s", azapp.Name)
-	outOption := tfexec.Out(planfile)
 	logr.Info(fmt.Sprintf("Initiating terraform plan of app [%s]", azapp.Name))
 	start := time.Now()
-	parallelism := tfexec.Parallelism(1)
-	changed, err := tfd.tfc.Plan(context.TODO(), outOption, parallelism)
+	changed, err := tfd.tfc.PlanAzureResources(ctx, planfile)
 	elapsed := time.Since(start)
 	logr.Info(fmt.Sprintf("[%s] plan duration: %v", azapp.Name, elapsed))
+	switch {
+	case err != nil:
+		metrics.CountPlan(metrics.PlanError, azapp.Name, azapp.Namespace)
+	case changed:
+		metrics.CountPlan(metrics.PlanChanged, azapp.Name, azapp.Namespace)
+	default:
+		metrics.CountPlan(metrics.PlanUnchanged, azapp.Name, azapp.Namespace)
+	}
+	if err == nil && !changed {
+		// nothing to apply, don't leave the plan behind
+		err = tfd.tfc.DiscardPlan(planfile)
+	}
 	return planfile, changed, err
 }
 
-func (tfd *TfDependenciesClient) ManageTerraformableExternalDependencies(ctx context.Context, azapp *k8sappv0alpha1.AzureApp, phase string, planfile string) error {
+func (tfd *TfDependenciesClient) ManageTerraformableExternalDependencies(ctx context.Context, azapp *k8sappv1alpha1.AzureApp, phase string, planfile string) error {
 	logr := logr.FromContextOrDiscard(ctx)
 	var err error
 	start := time.Now()
 	switch phase {
 	case "apply":
 		logr.Info(fmt.Sprintf("Initiating terraform apply of app [%s]", azapp.Name))
-		err = tfd.tfc.ReconcileAzureResources(planfile)
+		err = tfd.tfc.ReconcileAzureResources(ctx, planfile)
 	case "destroy":
 		err = tfd.tfc.DestroyAzureResources(ctx, azapp)
 	default:
@@ -55,45 +69,207 @@ func (tfd *TfDependenciesClient) ManageTerraformableExternalDependencies(ctx con
 	return err
 }
 
-func GetTerraformAppCredentialOutput(ctx context.Context, azapp *k8sappv0alpha1.AzureApp) (map[string]string, error) {
-	//refactor so I don't have to instantiate the client again here
-	tf, err := tf.NewTerraformClient(ctx, config.Config.TerraformExecutablePath, config.Config.TerraformBasePath, azapp)
+// ArchiveTerraformState moves the app terraform state to a tombstone key, leaving its Azure resources in place
+func (tfd *TfDependenciesClient) ArchiveTerraformState(ctx context.Context, azapp *k8sappv1alpha1.AzureApp) (string, error) {
+	return tfd.tfc.ArchiveStateFile(ctx, azapp)
+}
+
+// SummarizePlan returns what the saved planfile does to the app Azure resources
+func (tfd *TfDependenciesClient) SummarizePlan(ctx context.Context, planfile string) (*k8sappv1alpha1.PlanSummary, error) {
+	return tfd.tfc.SummarizePlan(ctx, planfile)
+}
+
+// DiscardPlan removes a saved planfile that won't be applied
+func (tfd *TfDependenciesClient) DiscardPlan(planfile string) error {
+	return tfd.tfc.DiscardPlan(planfile)
+}
+
+// InputsHash identifies the spec and rendered terraform inputs the client was created with
+func (tfd *TfDependenciesClient) InputsHash() string {
+	return tfd.tfc.InputsHash()
+}
+
+func (tfd *TfDependenciesClient) GetTerraformAppCredentialOutput(ctx context.Context) (map[string]string, error) {
+	return tfd.tfc.GetAzureAppCredential(ctx)
+}
+
+// ManageOtherExternalDependencies sets up what terraform can't manage and returns the resulting database access,
+// nil for apps without a database
+func ManageOtherExternalDependencies(ctx context.Context, azapp *k8sappv1alpha1.AzureApp) (*k8sappv1alpha1.DatabaseStatus, error) {
+	// currently, for this project, database user is the only external dependency not manageable by terraform
+	// Setup DB User
+	if !azapp.Spec.Database.Enabled {
+		return nil, nil
+	}
+	sqlclient, err := newSqlClient(ctx, azapp)
+	if err != nil {
+		return nil, err
+	}
+	defer sqlclient.Close()
+	status := DatabaseStatus(azapp)
+	if err := sqlclient.CreateUser(status.User); err != nil {
+		return nil, err
+	}
+	if err := sqlclient.SyncRoles(status.User, status.Roles); err != nil {
+		return nil, err
+	}
+	if err := sqlclient.SyncSchemaPermissions(status.User, schemaPermissions(azapp)); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// DropDatabaseUser drops the app database user, for apps whose database outlives them
+func DropDatabaseUser(ctx context.Context, azapp *k8sappv1alpha1.AzureApp) error {
+	sqlclient, err := newSqlClient(ctx, azapp)
+	if err != nil {
+		return err
+	}
+	defer sqlclient.Close()
+	return sqlclient.DropUser(DatabaseUser(azapp))
+}
+
+// ListDatabaseUsers lists the users created FROM EXTERNAL PROVIDER in the app database
+func ListDatabaseUsers(ctx context.Context, azapp *k8sappv1alpha1.AzureApp) ([]string, error) {
+	sqlclient, err := newSqlClient(ctx, azapp)
 	if err != nil {
 		return nil, err
 	}
+	defer sqlclient.Close()
+	return sqlclient.ListExternalUsers()
+}
 
-	return tf.GetAzureAppCredential()
+// DatabaseName is the Azure Sql Database of the app
+func DatabaseName(azapp *k8sappv1alpha1.AzureApp) string {
+	return fmt.Sprintf("%s-db", azapp.Spec.Identifier)
 }
 
-func ManageOtherExternalDependencies(azapp *k8sappv0alpha1.AzureApp) error {
-	// currently, for this project, database user is the only external dependency not manageable by terraform
-	// Setup DB User
-	if azapp.Spec.EnableDatabase {
-		sqlclient, err := db.NewServicePrincipalClient(
-			config.Config.ARMClientID,
-			config.Config.ARMClientSecret,
-			config.Config.DefaultSQLServer,
-			fmt.Sprintf("%s-db", azapp.Spec.Identifier),
-			context.TODO(),
-		)
-		if err != nil {
-			return err
-		}
-		username := fmt.Sprintf("%s-app", azapp.Spec.Identifier)
-		if err := sqlclient.CreateUser(username); err != nil {
-			return err
+// DatabaseServer is the host name of the Azure SQL server holding the app databases
+func DatabaseServer() string {
+	return db.ServerHost(config.Config.DefaultSQLServer)
+}
+
+// DatabaseConnectionString is the connection string the app signs in to its database with, as the service
+// principal appid of its app registration
+func DatabaseConnectionString(azapp *k8sappv1alpha1.AzureApp, appid, appsecret string) string {
+	return db.ServicePrincipalConnString(appid, appsecret, config.Config.DefaultSQLServer, DatabaseName(azapp))
+}
+
+// newSqlClient connects to the app database with the operator service principal
+func newSqlClient(ctx context.Context, azapp *k8sappv1alpha1.AzureApp) (*db.SqlClient, error) {
+	return db.NewServicePrincipalClient(
+		config.Config.ARMClientID,
+		config.Config.ARMClientSecret,
+		config.Config.DefaultSQLServer,
+		DatabaseName(azapp),
+		ctx,
+	)
+}
+
+// DatabaseUser is the contained database user of the app
+func DatabaseUser(azapp *k8sappv1alpha1.AzureApp) string {
+	return fmt.Sprintf("%s-app", azapp.Spec.Identifier)
+}
+
+// DatabaseStatus is the access the app database user has once its spec.database roles and schema grants are
+// applied, sorted so it can be compared with the status. Apps that set neither get db_owner, which is what every
+// app had before roles could be set. It's nil for apps without a database.
+func DatabaseStatus(azapp *k8sappv1alpha1.AzureApp) *k8sappv1alpha1.DatabaseStatus {
+	if !azapp.Spec.Database.Enabled {
+		return nil
+	}
+	status := &k8sappv1alpha1.DatabaseStatus{User: DatabaseUser(azapp)}
+	status.Roles = append(status.Roles, azapp.Spec.Database.Roles...)
+	if UsesDefaultDatabaseRole(azapp) {
+		status.Roles = []string{k8sappv1alpha1.DefaultDatabaseRole}
+	}
+	sort.Strings(status.Roles)
+	for _, p := range schemaPermissions(azapp) {
+		status.SchemaPermissions = append(status.SchemaPermissions, p.String())
+	}
+	sort.Strings(status.SchemaPermissions)
+	return status
+}
+
+// UsesDefaultDatabaseRole reports if the app database user falls back to db_owner because spec.database sets
+// neither roles nor schema grants
+func UsesDefaultDatabaseRole(azapp *k8sappv1alpha1.AzureApp) bool {
+	return azapp.Spec.Database.Enabled && len(azapp.Spec.Database.Roles) == 0 && len(azapp.Spec.Database.SchemaGrants) == 0
+}
+
+// schemaPermissions lists the permissions of the app spec.database.schemaGrants one by one
+func schemaPermissions(azapp *k8sappv1alpha1.AzureApp) []db.SchemaPermission {
+	var permissions []db.SchemaPermission
+	for _, grant := range azapp.Spec.Database.SchemaGrants {
+		for _, permission := range grant.Permissions {
+			permissions = append(permissions, db.SchemaPermission{Schema: grant.Schema, Permission: string(permission)})
 		}
-		if err := sqlclient.GrantOwner(username); err != nil {
-			return err
+	}
+	return permissions
+}
+
+// CertificateName is the app key vault certificate served by the ingress
+func CertificateName(azapp *k8sappv1alpha1.AzureApp) string {
+	if azapp.Spec.TLS.CertificateName == "" {
+		return k8sappv1alpha1.DefaultCertificateName
+	}
+	return azapp.Spec.TLS.CertificateName
+}
+
+// CertificateRequested tells if the operator creates the app certificate instead of waiting for it to be uploaded
+func CertificateRequested(azapp *k8sappv1alpha1.AzureApp) bool {
+	return azapp.Spec.TLS.Issuer != nil || azapp.Spec.TLS.SelfSigned
+}
+
+// GetCertificate reads the tls certificate and private key from the app key vault, it returns nil while the
+// certificate doesn't exist
+func GetCertificate(ctx context.Context, azapp *k8sappv1alpha1.AzureApp) (*az.TlsCertificate, error) {
+	azclient, err := az.NewAzureClient()
+	if err != nil {
+		return nil, err
+	}
+	return azclient.GetTlsCertificate(ctx, fmt.Sprintf("%s-kv", azapp.Spec.Identifier), CertificateName(azapp))
+}
+
+// GetKeyVaultSecrets reads the spec.keyVaultSecrets of the app from its key vault, in the order of the spec
+func GetKeyVaultSecrets(ctx context.Context, azapp *k8sappv1alpha1.AzureApp) ([]az.Secret, error) {
+	if len(azapp.Spec.KeyVaultSecrets) == 0 {
+		return nil, nil
+	}
+	azclient, err := az.NewAzureClient()
+	if err != nil {
+		return nil, err
+	}
+	secrets := make([]az.Secret, 0, len(azapp.Spec.KeyVaultSecrets))
+	for _, kvSecret := range azapp.Spec.KeyVaultSecrets {
+		secret, err := azclient.GetSecret(ctx, fmt.Sprintf("%s-kv", azapp.Spec.Identifier), kvSecret.Name, kvSecret.Version)
+		if err != nil {
+			return nil, err
 		}
+		secrets = append(secrets, *secret)
 	}
-	return nil
+	return secrets, nil
 }
 
-func CheckCertificate(azapp *k8sappv0alpha1.AzureApp) (bool, error) {
+// RequestCertificate creates the app certificate in its key vault from the spec.tls issuer, or self-signed,
+// unless it's already being created
+func RequestCertificate(ctx context.Context, azapp *k8sappv1alpha1.AzureApp) error {
 	azclient, err := az.NewAzureClient()
 	if err != nil {
-		return false, err
+		return err
+	}
+	req := az.CertificateRequest{
+		Name:             CertificateName(azapp),
+		Issuer:           az.SelfSignedIssuer,
+		Host:             azapp.Spec.Networking.Url,
+		ValidityInMonths: 12,
+	}
+	if issuer := azapp.Spec.TLS.Issuer; issuer != nil {
+		req.Issuer = issuer.Name
+		req.CertificateType = issuer.CertificateType
+		if issuer.ValidityInMonths != nil {
+			req.ValidityInMonths = *issuer.ValidityInMonths
+		}
 	}
-	return azclient.TlsCertificateExists(fmt.Sprintf("%s-kv", azapp.Spec.Identifier))
+	return azclient.RequestTlsCertificate(ctx, fmt.Sprintf("%s-kv", azapp.Spec.Identifier), req)
 }
@@ -0,0 +1,43 @@
+package dependencies
+
+import (
+	"reflect"
+	"testing"
+
+	k8sappv1alpha1 "github.com/rdalbuquerque/azure-operator/operator/api/v1alpha1"
+)
+
+func TestDatabaseStatus(t *testing.T) {
+	azapp := &k8sappv1alpha1.AzureApp{Spec: k8sappv1alpha1.AzureAppSpec{Identifier: "apprda001"}}
+	if status := DatabaseStatus(azapp); status != nil {
+		t.Errorf("app without a database has no database status, got %+v", status)
+	}
+
+	azapp.Spec.Database.Enabled = true
+	want := &k8sappv1alpha1.DatabaseStatus{User: "apprda001-app", Roles: []string{"db_owner"}}
+	if status := DatabaseStatus(azapp); !reflect.DeepEqual(status, want) {
+		t.Errorf("app that sets no roles keeps db_owner, expected %+v, got %+v", want, status)
+	}
+
+	azapp.Spec.Database.Roles = []string{"db_datawriter", "db_datareader"}
+	azapp.Spec.Database.SchemaGrants = []k8sappv1alpha1.SchemaGrant{
+		{Schema: "sales", Permissions: []k8sappv1alpha1.SchemaPermission{"SELECT", "EXECUTE"}},
+		{Schema: "hr", Permissions: []k8sappv1alpha1.SchemaPermission{"SELECT"}},
+	}
+	want = &k8sappv1alpha1.DatabaseStatus{
+		User:              "apprda001-app",
+		Roles:             []string{"db_datareader", "db_datawriter"},
+		SchemaPermissions: []string{"EXECUTE ON SCHEMA::sales", "SELECT ON SCHEMA::hr", "SELECT ON SCHEMA::sales"},
+	}
+	if status := DatabaseStatus(azapp); !reflect.DeepEqual(status, want) {
+		t.Errorf("expected %+v, got %+v", want, status)
+	}
+	if azapp.Spec.Database.Roles[0] != "db_datawriter" {
+		t.Error("sorting the status roles changed the spec")
+	}
+
+	azapp.Spec.Database.Roles = nil
+	if status := DatabaseStatus(azapp); status.Roles != nil {
+		t.Errorf("app with schema grants only shouldn't get db_owner, got %v", status.Roles)
+	}
+}
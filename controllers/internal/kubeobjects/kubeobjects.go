@@ -5,7 +5,10 @@ import (
 	"fmt"
 
 	"github.com/go-logr/logr"
-	k8sappv0alpha1 "github.com/rdalbuquerque/azure-operator/operator/api/v0alpha1"
+	k8sappv1alpha1 "github.com/rdalbuquerque/azure-operator/operator/api/v1alpha1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
@@ -36,7 +39,7 @@ func (k *KubeClient) ApplyAll(kubeobjects []client.Object) error {
 	return nil
 }
 
-func (k *KubeClient) SetProvisionState(provState string, azapp *k8sappv0alpha1.AzureApp) error {
+func (k *KubeClient) SetProvisionState(provState string, azapp *k8sappv1alpha1.AzureApp) error {
 	logr := logr.FromContextOrDiscard(k.context)
 	if provState != azapp.Status.ProvisioningState {
 		logr.Info(fmt.Sprintf("Setting provisioning state for app [%s]", azapp.Name))
@@ -51,7 +54,7 @@ func (k *KubeClient) SetProvisionState(provState string, azapp *k8sappv0alpha1.A
 	return nil
 }
 
-func (k *KubeClient) SetDeploymentName(deployment string, azapp *k8sappv0alpha1.AzureApp) error {
+func (k *KubeClient) SetDeploymentName(deployment string, azapp *k8sappv1alpha1.AzureApp) error {
 	logr := logr.FromContextOrDiscard(k.context)
 	if deployment != azapp.Status.Deployment {
 		logr.Info(fmt.Sprintf("Setting provisioning state for app [%s]", azapp.Name))
@@ -65,3 +68,106 @@ func (k *KubeClient) SetDeploymentName(deployment string, azapp *k8sappv0alpha1.
 	}
 	return nil
 }
+
+// SetConditions records the given conditions on the app status, patching it only when one of them changed
+func (k *KubeClient) SetConditions(azapp *k8sappv1alpha1.AzureApp, conditions ...metav1.Condition) error {
+	logr := logr.FromContextOrDiscard(k.context)
+	originalAzapp := azapp.DeepCopy()
+	changed := false
+	for _, condition := range conditions {
+		condition.ObservedGeneration = azapp.Generation
+		current := meta.FindStatusCondition(azapp.Status.Conditions, condition.Type)
+		if current != nil && current.Status == condition.Status && current.Reason == condition.Reason &&
+			current.Message == condition.Message && current.ObservedGeneration == condition.ObservedGeneration {
+			continue
+		}
+		meta.SetStatusCondition(&azapp.Status.Conditions, condition)
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	patch := client.MergeFrom(originalAzapp)
+	if err := k.Status().Patch(k.context, azapp, patch); err != nil {
+		return err
+	}
+	logr.Info(fmt.Sprintf("Successfully set conditions for app [%s]", azapp.Name))
+	return nil
+}
+
+// SetTerraformState records the inputs hash that terraform last planned successfully and when it happened,
+// when applied is true the time is also recorded as the last successful apply
+func (k *KubeClient) SetTerraformState(inputsHash string, applied bool, azapp *k8sappv1alpha1.AzureApp) error {
+	originalAzapp := azapp.DeepCopy()
+	now := metav1.Now()
+	azapp.Status.SpecHash = inputsHash
+	azapp.Status.LastPlanTime = &now
+	if applied {
+		azapp.Status.LastAppliedTime = &now
+	}
+	patch := client.MergeFrom(originalAzapp)
+	return k.Status().Patch(k.context, azapp, patch)
+}
+
+func (k *KubeClient) SetLastPlan(summary *k8sappv1alpha1.PlanSummary, azapp *k8sappv1alpha1.AzureApp) error {
+	originalAzapp := azapp.DeepCopy()
+	azapp.Status.LastPlan = summary
+	patch := client.MergeFrom(originalAzapp)
+	return k.Status().Patch(k.context, azapp, patch)
+}
+
+// SetCertificateStatus records the certificate version held by the app tls secret and when it expires
+func (k *KubeClient) SetCertificateStatus(certificate *k8sappv1alpha1.CertificateStatus, azapp *k8sappv1alpha1.AzureApp) error {
+	if equality.Semantic.DeepEqual(certificate, azapp.Status.Certificate) {
+		return nil
+	}
+	originalAzapp := azapp.DeepCopy()
+	azapp.Status.Certificate = certificate
+	patch := client.MergeFrom(originalAzapp)
+	return k.Status().Patch(k.context, azapp, patch)
+}
+
+// SetDatabaseStatus records the roles and schema permissions applied to the app database user
+func (k *KubeClient) SetDatabaseStatus(database *k8sappv1alpha1.DatabaseStatus, azapp *k8sappv1alpha1.AzureApp) error {
+	if equality.Semantic.DeepEqual(database, azapp.Status.Database) {
+		return nil
+	}
+	originalAzapp := azapp.DeepCopy()
+	azapp.Status.Database = database
+	patch := client.MergeFrom(originalAzapp)
+	return k.Status().Patch(k.context, azapp, patch)
+}
+
+// SetMigrationStatus records the schema migration Job that last succeeded
+func (k *KubeClient) SetMigrationStatus(migration *k8sappv1alpha1.MigrationStatus, azapp *k8sappv1alpha1.AzureApp) error {
+	if equality.Semantic.DeepEqual(migration, azapp.Status.Migration) {
+		return nil
+	}
+	originalAzapp := azapp.DeepCopy()
+	azapp.Status.Migration = migration
+	patch := client.MergeFrom(originalAzapp)
+	return k.Status().Patch(k.context, azapp, patch)
+}
+
+// SetKeyVaultSecretsStatus records the key vault secret versions held by the app key vault secrets secret
+func (k *KubeClient) SetKeyVaultSecretsStatus(kvSecrets []k8sappv1alpha1.KeyVaultSecretStatus, azapp *k8sappv1alpha1.AzureApp) error {
+	if equality.Semantic.DeepEqual(kvSecrets, azapp.Status.KeyVaultSecrets) {
+		return nil
+	}
+	originalAzapp := azapp.DeepCopy()
+	azapp.Status.KeyVaultSecrets = kvSecrets
+	patch := client.MergeFrom(originalAzapp)
+	return k.Status().Patch(k.context, azapp, patch)
+}
+
+func (k *KubeClient) SetObservedGeneration(azapp *k8sappv1alpha1.AzureApp) error {
+	if azapp.Generation != azapp.Status.ObservedGeneration {
+		originalAzapp := azapp.DeepCopy()
+		azapp.Status.ObservedGeneration = azapp.Generation
+		patch := client.MergeFrom(originalAzapp)
+		if err := k.Status().Patch(k.context, azapp, patch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+// Package metrics holds the operator Prometheus metrics. They are registered on the controller-runtime
+// registry, so the manager metrics endpoint serves them along with the controller-runtime ones.
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	k8sappv1alpha1 "github.com/rdalbuquerque/azure-operator/operator/api/v1alpha1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	crmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// terraform operations and plan outcomes used as label values
+const (
+	OperationInit    = "init"
+	OperationPlan    = "plan"
+	OperationApply   = "apply"
+	OperationDestroy = "destroy"
+
+	PlanChanged   = "changed"
+	PlanUnchanged = "unchanged"
+	PlanError     = "error"
+)
+
+var (
+	terraformDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "azureapp_terraform_duration_seconds",
+		Help:    "Duration of terraform init, plan, apply and destroy runs per app.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 12),
+	}, []string{"operation", "app", "namespace"})
+	terraformPlans = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "azureapp_terraform_plans_total",
+		Help: "Terraform plans per app by outcome: changed, unchanged or error.",
+	}, []string{"outcome", "app", "namespace"})
+	orphanedDatabaseUsers = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "azureapp_orphaned_database_users",
+		Help: "Database users named after an AzureApp that no longer exists, per app database.",
+	}, []string{"database"})
+)
+
+func init() {
+	crmetrics.Registry.MustRegister(terraformDuration, terraformPlans, orphanedDatabaseUsers)
+}
+
+// ObserveTerraform records the duration of a terraform operation of an app that started at start
+func ObserveTerraform(operation, app, namespace string, start time.Time) {
+	terraformDuration.WithLabelValues(operation, app, namespace).Observe(time.Since(start).Seconds())
+}
+
+// CountPlan counts a terraform plan of an app by its outcome
+func CountPlan(outcome, app, namespace string) {
+	terraformPlans.WithLabelValues(outcome, app, namespace).Inc()
+}
+
+// SetOrphanedDatabaseUsers replaces the orphaned database users gauge with the counts per database of the last scan
+func SetOrphanedDatabaseUsers(counts map[string]int) {
+	orphanedDatabaseUsers.Reset()
+	for database, count := range counts {
+		orphanedDatabaseUsers.WithLabelValues(database).Set(float64(count))
+	}
+}
+
+// ForgetApp removes the series of a deleted app
+func ForgetApp(app, namespace string) {
+	for _, operation := range []string{OperationInit, OperationPlan, OperationApply, OperationDestroy} {
+		terraformDuration.DeleteLabelValues(operation, app, namespace)
+	}
+	for _, outcome := range []string{PlanChanged, PlanUnchanged, PlanError} {
+		terraformPlans.DeleteLabelValues(outcome, app, namespace)
+	}
+}
+
+var (
+	appsDesc = prometheus.NewDesc("azureapp_apps",
+		"Number of AzureApps per provisioning state.", []string{"provisioning_state"}, nil)
+	certificateWaitDesc = prometheus.NewDesc("azureapp_certificate_wait_seconds",
+		"How long an AzureApp has been waiting on its tls certificate.", []string{"app", "namespace"}, nil)
+)
+
+// AppsCollector reports the gauges that describe every AzureApp, computed from the cache at scrape time
+// so they never drift from the apps status
+type AppsCollector struct {
+	client client.Reader
+}
+
+// NewAppsCollector returns a collector listing AzureApps with reader, usually the manager cached client
+func NewAppsCollector(reader client.Reader) *AppsCollector {
+	return &AppsCollector{client: reader}
+}
+
+func (c *AppsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- appsDesc
+	ch <- certificateWaitDesc
+}
+
+func (c *AppsCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var azapps k8sappv1alpha1.AzureAppList
+	if err := c.client.List(ctx, &azapps); err != nil {
+		ch <- prometheus.NewInvalidMetric(appsDesc, err)
+		return
+	}
+	states := map[string]int{}
+	for _, azapp := range azapps.Items {
+		states[azapp.Status.ProvisioningState]++
+		cond := meta.FindStatusCondition(azapp.Status.Conditions, k8sappv1alpha1.ConditionCertificateReady)
+		if cond != nil && cond.Status == metav1.ConditionFalse {
+			ch <- prometheus.MustNewConstMetric(certificateWaitDesc, prometheus.GaugeValue,
+				time.Since(cond.LastTransitionTime.Time).Seconds(), azapp.Name, azapp.Namespace)
+		}
+	}
+	for state, count := range states {
+		ch <- prometheus.MustNewConstMetric(appsDesc, prometheus.GaugeValue, float64(count), state)
+	}
+}
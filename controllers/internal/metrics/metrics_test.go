@@ -0,0 +1,66 @@
+package metrics
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	k8sappv1alpha1 "github.com/rdalbuquerque/azure-operator/operator/api/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// listReader serves a fixed AzureApp list
+type listReader struct {
+	client.Reader
+	azapps []k8sappv1alpha1.AzureApp
+}
+
+func (r listReader) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	list.(*k8sappv1alpha1.AzureAppList).Items = r.azapps
+	return nil
+}
+
+func TestAppsCollector(t *testing.T) {
+	waitingSince := metav1.NewTime(time.Now().Add(-time.Hour))
+	waiting := k8sappv1alpha1.AzureApp{
+		ObjectMeta: metav1.ObjectMeta{Name: "app1", Namespace: "team-a"},
+		Status: k8sappv1alpha1.AzureAppStatus{
+			ProvisioningState: "Waiting certificate",
+			Conditions: []metav1.Condition{{
+				Type: k8sappv1alpha1.ConditionCertificateReady, Status: metav1.ConditionFalse, Reason: "CertificateMissing", LastTransitionTime: waitingSince,
+			}},
+		},
+	}
+	provisioned := k8sappv1alpha1.AzureApp{
+		ObjectMeta: metav1.ObjectMeta{Name: "app2", Namespace: "team-a"},
+		Status:     k8sappv1alpha1.AzureAppStatus{ProvisioningState: "Provisioned"},
+	}
+
+	ch := make(chan prometheus.Metric, 10)
+	NewAppsCollector(listReader{azapps: []k8sappv1alpha1.AzureApp{waiting, provisioned, provisioned}}).Collect(ch)
+	close(ch)
+
+	states := map[string]float64{}
+	var certWait float64
+	for m := range ch {
+		var metric dto.Metric
+		if err := m.Write(&metric); err != nil {
+			t.Fatal(err)
+		}
+		switch m.Desc() {
+		case appsDesc:
+			states[metric.GetLabel()[0].GetValue()] = metric.GetGauge().GetValue()
+		case certificateWaitDesc:
+			certWait = metric.GetGauge().GetValue()
+		}
+	}
+	if states["Provisioned"] != 2 || states["Waiting certificate"] != 1 {
+		t.Errorf("unexpected apps per state %v", states)
+	}
+	if certWait < time.Hour.Seconds() || certWait > time.Hour.Seconds()+60 {
+		t.Errorf("expected app1 to be waiting on its certificate for an hour, got %vs", certWait)
+	}
+}
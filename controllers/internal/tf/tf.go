@@ -1,31 +1,73 @@
 package tf
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"path"
+	"path/filepath"
+	"sync"
 	"text/template"
+	"time"
 
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
 	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
 	"github.com/hashicorp/terraform-exec/tfexec"
-	k8sappv0alpha1 "github.com/rdalbuquerque/azure-operator/operator/api/v0alpha1"
+	k8sappv1alpha1 "github.com/rdalbuquerque/azure-operator/operator/api/v1alpha1"
 	"github.com/rdalbuquerque/azure-operator/operator/controllers/config"
+	"github.com/rdalbuquerque/azure-operator/operator/controllers/internal/metrics"
+	"github.com/rdalbuquerque/azure-operator/operator/controllers/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+// TfClient runs terraform for a single app. Every command runs with the app workdir as its own working
+// directory, the process working directory is never changed so clients can be used concurrently.
 type TfClient struct {
 	*tfexec.Terraform
+	// inputsHash identifies the rendered main.tf and var file, mainHash only main.tf which is what init depends on
+	inputsHash string
+	mainHash   string
+	// app and namespace label the terraform metrics of the app
+	app       string
+	namespace string
+	// stateKey and legacyStateKey are the app state blobs in the backend container, see adoptLegacyState
+	stateKey       string
+	legacyStateKey string
 }
 
-func NewTerraformClient(ctx context.Context, tfExePath, tfBaseDir string, azapp *k8sappv0alpha1.AzureApp) (*TfClient, error) {
-	workdir := fmt.Sprintf("%s/%s", tfBaseDir, azapp.Name)
-	if err := os.Mkdir(workdir, os.FileMode(0666)); err != nil {
-		if !os.IsExist(err) {
-			return nil, err
-		}
+// ErrStalePlan is returned when a saved plan no longer matches the app inputs, the plan is discarded
+// and a new one has to be made before applying
+var ErrStalePlan = errors.New("saved terraform plan is stale")
+
+// workdirLocks serializes terraform runs that target the same workdir, runs on different workdirs don't block each other
+var workdirLocks sync.Map
+
+func lockWorkdir(workdir string) func() {
+	mu, _ := workdirLocks.LoadOrStore(workdir, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	return mu.(*sync.Mutex).Unlock
+}
+
+// NewTerraformClient renders the terraform inputs of the app in its workdir, <tfBaseDir>/<namespace>/<name>, so apps
+// with the same name in different namespaces never share a workdir, a lock or a state
+func NewTerraformClient(ctx context.Context, tfExePath, tfBaseDir string, azapp *k8sappv1alpha1.AzureApp) (*TfClient, error) {
+	workdir := filepath.Join(tfBaseDir, azapp.Namespace, azapp.Name)
+	unlock := lockWorkdir(workdir)
+	defer unlock()
+	if err := os.MkdirAll(workdir, os.FileMode(0777)); err != nil {
+		return nil, err
 	}
 	if err := os.Chmod(workdir, os.FileMode(0777)); err != nil {
 		return nil, err
@@ -34,20 +76,80 @@ func NewTerraformClient(ctx context.Context, tfExePath, tfBaseDir string, azapp
 	if err != nil {
 		return nil, err
 	}
-	if err := renderTerraformMain(azapp, tfBaseDir); err != nil {
-		return nil, err
-	}
-	if err := generateTerraformVarFile(azapp, workdir); err != nil {
+	maintf, err := renderTerraformMain(azapp, tfBaseDir, workdir)
+	if err != nil {
 		return nil, err
 	}
-	if err := tf.Init(ctx); err != nil {
+	tfvars, err := generateTerraformVarFile(azapp, workdir)
+	if err != nil {
 		return nil, err
 	}
 	return &TfClient{
-		Terraform: tf,
+		Terraform:      tf,
+		inputsHash:     hashOf(maintf, tfvars),
+		mainHash:       hashOf(maintf),
+		app:            azapp.Name,
+		namespace:      azapp.Namespace,
+		stateKey:       stateKey(azapp),
+		legacyStateKey: legacyStateKey(azapp),
 	}, nil
 }
 
+// InputsHash returns a hash of the rendered terraform inputs of the app, it only changes when the spec or
+// the main.tf template change
+func (tf *TfClient) InputsHash() string {
+	return tf.inputsHash
+}
+
+// ensureInit runs terraform init unless the workdir was already initialized for the current main.tf.
+// Callers must hold the workdir lock.
+func (tf *TfClient) ensureInit(ctx context.Context) error {
+	marker := filepath.Join(tf.WorkingDir(), ".terraform", "init.sha256")
+	if initHash, err := ioutil.ReadFile(marker); err == nil && string(initHash) == tf.mainHash {
+		return nil
+	}
+	if err := tf.adoptLegacyState(ctx); err != nil {
+		return err
+	}
+	ctx, span := tf.startSpan(ctx, "init")
+	start := time.Now()
+	err := tf.Init(ctx)
+	metrics.ObserveTerraform(metrics.OperationInit, tf.app, tf.namespace, start)
+	tracing.End(span, err)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(marker), os.FileMode(0777)); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(marker, []byte(tf.mainHash), 0666)
+}
+
+// startSpan starts the span of a terraform command run for the app
+func (tf *TfClient) startSpan(ctx context.Context, command string) (context.Context, trace.Span) {
+	return tracing.Start(ctx, fmt.Sprintf("terraform %s", command),
+		attribute.String("terraform.command", command),
+		attribute.String("azureapp.name", tf.app),
+		attribute.String("azureapp.namespace", tf.namespace),
+	)
+}
+
+func hashOf(contents ...[]byte) string {
+	h := sha256.New()
+	for _, c := range contents {
+		h.Write(c)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// writeIfChanged only touches the file when its content differs
+func writeIfChanged(filename string, content []byte) error {
+	if current, err := ioutil.ReadFile(filename); err == nil && bytes.Equal(current, content) {
+		return nil
+	}
+	return ioutil.WriteFile(filename, content, 0666)
+}
+
 type tfBackendInfo struct {
 	ResourceGroup  string
 	StorageAccount string
@@ -55,41 +157,59 @@ type tfBackendInfo struct {
 	Key            string
 }
 
-func renderTerraformMain(azapp *k8sappv0alpha1.AzureApp, tfDir string) error {
+func renderTerraformMain(azapp *k8sappv1alpha1.AzureApp, tfDir, workdir string) ([]byte, error) {
 	backendInfo := tfBackendInfo{}
 	backendInfo.ResourceGroup = config.Config.TerraformBackendResourceGroup
 	backendInfo.StorageAccount = config.Config.TerraformBackendStorageAccount
 	backendInfo.Container = config.Config.TerraformBackendContainer
-	backendInfo.Key = azapp.Name
+	backendInfo.Key = appKey(azapp)
 
 	tmplFile := fmt.Sprintf("%s/main.tf.gotmpl", tfDir)
-	maintf, _ := os.Create(fmt.Sprintf("%s/%s/main.tf", tfDir, azapp.Name))
 	tmplName := path.Base(tmplFile)
 	tmpl, err := template.New(tmplName).ParseFiles(tmplFile)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	var maintf bytes.Buffer
+	if err := tmpl.Execute(&maintf, backendInfo); err != nil {
+		return nil, err
 	}
-	return tmpl.Execute(maintf, backendInfo)
+	return maintf.Bytes(), writeIfChanged(fmt.Sprintf("%s/main.tf", workdir), maintf.Bytes())
 }
 
-func generateTerraformVarFile(azapp *k8sappv0alpha1.AzureApp, workdir string) error {
-	tfvarFileName := fmt.Sprintf("%s/spec.auto.tfvars.json", workdir)
-	jsonspec, err := json.Marshal(azapp.Spec)
-	if err != nil {
-		return err
-	}
+// terraformVars are the spec fields passed to the variables of main.tf.gotmpl
+type terraformVars struct {
+	Identifier     string   `json:"identifier"`
+	IdentifierURI  string   `json:"identifierUri"`
+	AppRoles       []string `json:"appRoles,omitempty"`
+	EnableDatabase bool     `json:"enableDatabase"`
+}
 
-	err = ioutil.WriteFile(tfvarFileName, jsonspec, 0666)
+func generateTerraformVarFile(azapp *k8sappv1alpha1.AzureApp, workdir string) ([]byte, error) {
+	tfvarFileName := fmt.Sprintf("%s/spec.auto.tfvars.json", workdir)
+	jsonspec, err := json.Marshal(terraformVars{
+		Identifier:     azapp.Spec.Identifier,
+		IdentifierURI:  azapp.Spec.AzureAD.IdentifierURI,
+		AppRoles:       azapp.Spec.AzureAD.AppRoles,
+		EnableDatabase: azapp.Spec.Database.Enabled,
+	})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	return jsonspec, writeIfChanged(tfvarFileName, jsonspec)
 }
 
-func (tf *TfClient) GetAzureAppCredential() (map[string]string, error) {
+func (tf *TfClient) GetAzureAppCredential(ctx context.Context) (map[string]string, error) {
+	unlock := lockWorkdir(tf.WorkingDir())
+	defer unlock()
+	if err := tf.ensureInit(ctx); err != nil {
+		return nil, err
+	}
 	appCreds := make(map[string]string)
-	output, err := tf.Output(context.Background())
+	ctx, span := tf.startSpan(ctx, "output")
+	output, err := tf.Output(ctx)
+	tracing.End(span, err)
 	if err != nil {
 		return nil, err
 	}
@@ -98,19 +218,171 @@ func (tf *TfClient) GetAzureAppCredential() (map[string]string, error) {
 	return appCreds, nil
 }
 
-func (tf *TfClient) ReconcileAzureResources(planfile string) error {
-	if err := os.Chdir(tf.WorkingDir()); err != nil {
+// PlanAzureResources runs terraform plan writing the plan to planfile, relative to the workdir
+func (tf *TfClient) PlanAzureResources(ctx context.Context, planfile string) (bool, error) {
+	unlock := lockWorkdir(tf.WorkingDir())
+	defer unlock()
+	if err := tf.ensureInit(ctx); err != nil {
+		return false, err
+	}
+	parallelism := tfexec.Parallelism(1)
+	ctx, span := tf.startSpan(ctx, "plan")
+	start := time.Now()
+	changed, err := tf.Plan(ctx, tfexec.Out(planfile), parallelism)
+	metrics.ObserveTerraform(metrics.OperationPlan, tf.app, tf.namespace, start)
+	span.SetAttributes(attribute.Bool("terraform.plan.changed", changed))
+	tracing.End(span, err)
+	if err != nil {
+		return changed, err
+	}
+	// the apply checks the plan against the inputs it was made from, the workdir lock is held so they can't
+	// change in between
+	inputsHash, err := tf.workdirInputsHash()
+	if err != nil {
+		return changed, err
+	}
+	return changed, ioutil.WriteFile(filepath.Join(tf.WorkingDir(), planHashFile(planfile)), []byte(inputsHash), 0666)
+}
+
+// ReconcileAzureResources applies exactly the saved planfile, so terraform doesn't plan again and only the
+// changes that were reviewed get applied. The planfile is always removed afterwards.
+func (tf *TfClient) ReconcileAzureResources(ctx context.Context, planfile string) error {
+	unlock := lockWorkdir(tf.WorkingDir())
+	defer unlock()
+	defer tf.discardPlan(planfile)
+	stale, err := tf.planIsStale(planfile)
+	if err != nil {
+		return err
+	}
+	if stale {
+		return ErrStalePlan
+	}
+	if err := tf.ensureInit(ctx); err != nil {
 		return err
 	}
 	parallelism := tfexec.Parallelism(1)
-	return tf.Apply(context.Background(), parallelism)
+	ctx, span := tf.startSpan(ctx, "apply")
+	start := time.Now()
+	err = tf.Apply(ctx, tfexec.DirOrPlan(planfile), parallelism)
+	metrics.ObserveTerraform(metrics.OperationApply, tf.app, tf.namespace, start)
+	tracing.End(span, err)
+	return err
+}
+
+// SummarizePlan counts the resources the saved planfile adds, changes and destroys. Only addresses and
+// actions are kept from the plan JSON, so no attribute value, sensitive or not, leaves this function.
+func (tf *TfClient) SummarizePlan(ctx context.Context, planfile string) (*k8sappv1alpha1.PlanSummary, error) {
+	unlock := lockWorkdir(tf.WorkingDir())
+	defer unlock()
+	ctx, span := tf.startSpan(ctx, "show")
+	plan, err := tf.ShowPlanFile(ctx, planfile)
+	tracing.End(span, err)
+	if err != nil {
+		return nil, err
+	}
+	summary := &k8sappv1alpha1.PlanSummary{Time: metav1.Now()}
+	changesHash := sha256.New()
+	for _, rc := range plan.ResourceChanges {
+		if rc.Change == nil {
+			continue
+		}
+		var action string
+		switch actions := rc.Change.Actions; {
+		case actions.Replace():
+			action = "replace"
+			summary.Add++
+			summary.Destroy++
+		case actions.Create():
+			action = "create"
+			summary.Add++
+		case actions.Update():
+			action = "update"
+			summary.Change++
+		case actions.Delete():
+			action = "delete"
+			summary.Destroy++
+		default:
+			// no-op and data source reads don't change Azure
+			continue
+		}
+		summary.Resources = append(summary.Resources, k8sappv1alpha1.PlannedResource{Address: rc.Address, Action: action})
+		// values only feed the hash, so a plan with the same addresses but other values needs a new approval
+		change, err := json.Marshal([]interface{}{rc.Address, rc.Change.Actions, rc.Change.Before, rc.Change.After, rc.Change.AfterUnknown})
+		if err != nil {
+			return nil, err
+		}
+		changesHash.Write(change)
+	}
+	summary.Hash = hex.EncodeToString(changesHash.Sum(nil))
+	return summary, nil
+}
+
+// DiscardPlan removes a saved planfile that is not going to be applied
+func (tf *TfClient) DiscardPlan(planfile string) error {
+	unlock := lockWorkdir(tf.WorkingDir())
+	defer unlock()
+	return tf.discardPlan(planfile)
 }
 
-func (tf *TfClient) DestroyAzureResources(ctx context.Context, azapp *k8sappv0alpha1.AzureApp) error {
-	if err := os.Chdir(tf.WorkingDir()); err != nil {
+func (tf *TfClient) discardPlan(planfile string) error {
+	for _, file := range []string{planfile, planHashFile(planfile)} {
+		if err := os.Remove(filepath.Join(tf.WorkingDir(), file)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// planHashFile is saved next to planfile with the hash of the inputs it was planned from
+func planHashFile(planfile string) string {
+	return planfile + ".sha256"
+}
+
+// workdirInputsHash hashes the terraform inputs currently written in the workdir like InputsHash does when
+// they're rendered. Callers must hold the workdir lock.
+func (tf *TfClient) workdirInputsHash() (string, error) {
+	var inputs [][]byte
+	for _, input := range []string{"main.tf", "spec.auto.tfvars.json"} {
+		content, err := ioutil.ReadFile(filepath.Join(tf.WorkingDir(), input))
+		if err != nil {
+			return "", err
+		}
+		inputs = append(inputs, content)
+	}
+	return hashOf(inputs...), nil
+}
+
+// planIsStale reports if the terraform inputs of the workdir changed since planfile was saved, a plan without
+// its inputs hash is stale too
+func (tf *TfClient) planIsStale(planfile string) (bool, error) {
+	if _, err := os.Stat(filepath.Join(tf.WorkingDir(), planfile)); err != nil {
+		return false, err
+	}
+	planned, err := ioutil.ReadFile(filepath.Join(tf.WorkingDir(), planHashFile(planfile)))
+	if os.IsNotExist(err) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	current, err := tf.workdirInputsHash()
+	if err != nil {
+		return false, err
+	}
+	return string(planned) != current, nil
+}
+
+func (tf *TfClient) DestroyAzureResources(ctx context.Context, azapp *k8sappv1alpha1.AzureApp) error {
+	unlock := lockWorkdir(tf.WorkingDir())
+	defer unlock()
+	if err := tf.ensureInit(ctx); err != nil {
 		return err
 	}
-	if err := tf.Destroy(context.TODO()); err == nil {
+	destroyCtx, span := tf.startSpan(ctx, "destroy")
+	start := time.Now()
+	err := tf.Destroy(destroyCtx)
+	metrics.ObserveTerraform(metrics.OperationDestroy, tf.app, tf.namespace, start)
+	tracing.End(span, err)
+	if err == nil {
 		if err := tf.deleteStateFile(ctx, azapp); err != nil {
 			return err
 		}
@@ -120,17 +392,148 @@ func (tf *TfClient) DestroyAzureResources(ctx context.Context, azapp *k8sappv0al
 	return nil
 }
 
-func (tf *TfClient) deleteStateFile(ctx context.Context, azapp *k8sappv0alpha1.AzureApp) error {
-	azcred, err := azidentity.NewClientSecretCredential(config.Config.ARMTenantID, config.Config.ARMClientID, config.Config.ARMClientSecret, nil)
+func (tf *TfClient) deleteStateFile(ctx context.Context, azapp *k8sappv1alpha1.AzureApp) error {
+	bbClient, err := stateBlobClient(stateKey(azapp))
 	if err != nil {
 		return err
 	}
-	bbClient, err := blockblob.NewClient(fmt.Sprintf("https://%s.blob.core.windows.net/state/k8sapp.%s.json", config.Config.TerraformBackendStorageAccount, azapp.Name), azcred, nil)
+	if _, err := bbClient.Delete(ctx, nil); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ArchiveStateFile moves the app terraform state to a tombstone key and returns that key, the Azure resources
+// are kept and can be adopted again by copying the tombstone back to the app state key. An app that was never
+// applied has no state to archive and returns an empty key. The tombstone key only depends on the app UID so a
+// retry after a failed attempt overwrites the same tombstone, or finds it when the state was already moved.
+func (tf *TfClient) ArchiveStateFile(ctx context.Context, azapp *k8sappv1alpha1.AzureApp) (string, error) {
+	unlock := lockWorkdir(tf.WorkingDir())
+	defer unlock()
+	tombstone := tombstoneKey(azapp)
+	stateClient, err := newStateBlob(stateKey(azapp))
+	if err != nil {
+		return "", err
+	}
+	tombstoneClient, err := newStateBlob(tombstone)
+	if err != nil {
+		return "", err
+	}
+	moved, err := moveState(ctx, stateClient, tombstoneClient, stateKey(azapp))
+	if err != nil {
+		return "", err
+	}
+	if moved {
+		return tombstone, nil
+	}
+	if _, err := tombstoneClient.GetProperties(ctx, nil); err != nil {
+		if blobNotFound(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	return tombstone, nil
+}
+
+// adoptLegacyState moves the state of an app planned before state keys included the namespace to its current key,
+// so the first init after an upgrade keeps managing the same Azure resources. It does nothing once the app has a
+// state under its current key. Callers must hold the workdir lock.
+func (tf *TfClient) adoptLegacyState(ctx context.Context) error {
+	stateClient, err := newStateBlob(tf.stateKey)
 	if err != nil {
 		return err
 	}
-	if _, err := bbClient.Delete(context.TODO(), nil); err != nil {
+	if _, err := stateClient.GetProperties(ctx, nil); err == nil || !blobNotFound(err) {
 		return err
 	}
-	return nil
+	legacyClient, err := newStateBlob(tf.legacyStateKey)
+	if err != nil {
+		return err
+	}
+	_, err = moveState(ctx, legacyClient, stateClient, tf.legacyStateKey)
+	return err
+}
+
+// moveState copies the state blob from to and deletes it, reporting false when there's no state at from. A state
+// locked by a running terraform operation isn't moved, and it's only deleted if it didn't change since it was read,
+// a state written in between fails the delete and is moved again on retry.
+func moveState(ctx context.Context, from, to stateBlob, key string) (bool, error) {
+	download, err := from.DownloadStream(ctx, nil)
+	if err != nil {
+		if blobNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer download.Body.Close()
+	if download.LeaseStatus != nil && *download.LeaseStatus == blob.LeaseStatusTypeLocked {
+		return false, fmt.Errorf("terraform state %s is locked by a running terraform operation", key)
+	}
+	state, err := io.ReadAll(download.Body)
+	if err != nil {
+		return false, err
+	}
+	if _, err := to.UploadBuffer(ctx, state, nil); err != nil {
+		return false, err
+	}
+	deleteOptions := &blob.DeleteOptions{AccessConditions: &blob.AccessConditions{
+		ModifiedAccessConditions: &blob.ModifiedAccessConditions{IfMatch: download.ETag},
+	}}
+	if _, err := from.Delete(ctx, deleteOptions); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// tombstoneKey is the blob name ArchiveStateFile moves the app state to
+func tombstoneKey(azapp *k8sappv1alpha1.AzureApp) string {
+	return fmt.Sprintf("tombstones/%s.%s", azapp.UID, stateKey(azapp))
+}
+
+func blobNotFound(err error) bool {
+	var responseError *azcore.ResponseError
+	return errors.As(err, &responseError) && responseError.StatusCode == http.StatusNotFound
+}
+
+// appKey identifies the app across namespaces in the backend container, namespaces can't contain dots so
+// it's unambiguous
+func appKey(azapp *k8sappv1alpha1.AzureApp) string {
+	return fmt.Sprintf("%s.%s", azapp.Namespace, azapp.Name)
+}
+
+// stateKey is the blob name of the app state in the terraform backend container, it must match the backend key in main.tf.gotmpl
+func stateKey(azapp *k8sappv1alpha1.AzureApp) string {
+	return fmt.Sprintf("k8sapp.%s.json", appKey(azapp))
+}
+
+// legacyStateKey is the blob name of the app state before state keys included the namespace
+func legacyStateKey(azapp *k8sappv1alpha1.AzureApp) string {
+	return fmt.Sprintf("k8sapp.%s.json", azapp.Name)
+}
+
+// stateBlob is the part of the blob client ArchiveStateFile uses
+type stateBlob interface {
+	DownloadStream(ctx context.Context, o *blob.DownloadStreamOptions) (blob.DownloadStreamResponse, error)
+	GetProperties(ctx context.Context, o *blob.GetPropertiesOptions) (blob.GetPropertiesResponse, error)
+	UploadBuffer(ctx context.Context, buffer []byte, o *blockblob.UploadBufferOptions) (blockblob.UploadBufferResponse, error)
+	Delete(ctx context.Context, o *blob.DeleteOptions) (blob.DeleteResponse, error)
+}
+
+// newStateBlob opens a blob of the terraform backend container, tests replace it with an in memory backend
+var newStateBlob = func(key string) (stateBlob, error) {
+	client, err := stateBlobClient(key)
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+func stateBlobClient(key string) (*blockblob.Client, error) {
+	azcred, err := azidentity.NewClientSecretCredential(config.Config.ARMTenantID, config.Config.ARMClientID, config.Config.ARMClientSecret,
+		&azidentity.ClientSecretCredentialOptions{ClientOptions: tracing.ClientOptions()})
+	if err != nil {
+		return nil, err
+	}
+	return blockblob.NewClient(fmt.Sprintf("https://%s.blob.core.windows.net/%s/%s", config.Config.TerraformBackendStorageAccount, config.Config.TerraformBackendContainer, key), azcred,
+		&blockblob.ClientOptions{ClientOptions: tracing.ClientOptions()})
 }
@@ -0,0 +1,571 @@
+package tf
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
+	k8sappv1alpha1 "github.com/rdalbuquerque/azure-operator/operator/api/v1alpha1"
+	"github.com/rdalbuquerque/azure-operator/operator/controllers/tracing"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// stubTerraform records the physical working directory and arguments of every call into calls.log
+// inside that directory, plan always reports changes and writes the requested plan file
+const stubTerraform = `#!/bin/sh
+echo "$(pwd -P) $*" >> calls.log
+case "$1" in
+version)
+	echo '{"terraform_version":"1.5.5","platform":"linux_amd64","provider_selections":{},"terraform_outdated":false}'
+	;;
+plan)
+	for arg in "$@"; do
+		case "$arg" in -out=*) echo stub > "${arg#-out=}" ;; esac
+	done
+	exit 2
+	;;
+show)
+	cat "$STUB_PLAN_JSON"
+	;;
+esac
+exit 0
+`
+
+func newStubEnv(t *testing.T) (string, string) {
+	t.Helper()
+	baseDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(baseDir, "main.tf.gotmpl"), []byte(`key = "k8sapp.{{ .Key}}.json"`), 0666); err != nil {
+		t.Fatal(err)
+	}
+	tfExe := filepath.Join(t.TempDir(), "terraform")
+	if err := os.WriteFile(tfExe, []byte(stubTerraform), 0755); err != nil {
+		t.Fatal(err)
+	}
+	newFakeBackend(t)
+	return baseDir, tfExe
+}
+
+func TestConcurrentAppsRunInTheirOwnWorkdir(t *testing.T) {
+	baseDir, tfExe := newStubEnv(t)
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every name is used in both namespaces, apps with the same name must still run side by side
+	var apps []metav1.ObjectMeta
+	for _, namespace := range []string{"team-a", "team-b"} {
+		for i := 0; i < 3; i++ {
+			apps = append(apps, metav1.ObjectMeta{Name: fmt.Sprintf("app%d", i), Namespace: namespace})
+		}
+	}
+	var wg sync.WaitGroup
+	for _, app := range apps {
+		wg.Add(1)
+		go func(app metav1.ObjectMeta) {
+			defer wg.Done()
+			ctx := context.Background()
+			azapp := &k8sappv1alpha1.AzureApp{ObjectMeta: app}
+			tfc, err := NewTerraformClient(ctx, tfExe, baseDir, azapp)
+			if err != nil {
+				t.Errorf("[%s/%s] new client: %s", app.Namespace, app.Name, err)
+				return
+			}
+			planfile := fmt.Sprintf("plan-%s", app.Name)
+			changed, err := tfc.PlanAzureResources(ctx, planfile)
+			if err != nil || !changed {
+				t.Errorf("[%s/%s] plan: changed=%v err=%v", app.Namespace, app.Name, changed, err)
+				return
+			}
+			if err := tfc.ReconcileAzureResources(ctx, planfile); err != nil {
+				t.Errorf("[%s/%s] apply: %s", app.Namespace, app.Name, err)
+			}
+		}(app)
+	}
+	wg.Wait()
+
+	if after, _ := os.Getwd(); after != cwd {
+		t.Errorf("process working directory changed from %s to %s", cwd, after)
+	}
+	for _, app := range apps {
+		id := app.Namespace + "/" + app.Name
+		workdir, err := filepath.EvalSymlinks(filepath.Join(baseDir, app.Namespace, app.Name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		calls, err := os.ReadFile(filepath.Join(workdir, "calls.log"))
+		if err != nil {
+			t.Fatalf("%s: %s", id, err)
+		}
+		var commands []string
+		for _, line := range strings.Split(strings.TrimSpace(string(calls)), "\n") {
+			dir, args, _ := strings.Cut(line, " ")
+			if dir != workdir {
+				t.Errorf("%s: terraform ran in %s instead of %s", id, dir, workdir)
+			}
+			cmd, _, _ := strings.Cut(args, " ")
+			if cmd == "version" {
+				continue
+			}
+			commands = append(commands, cmd)
+			if planfile := fmt.Sprintf("plan-%s", app.Name); cmd == "apply" && !strings.HasSuffix(args, " "+planfile) {
+				t.Errorf("%s: apply didn't use the saved plan: %s", id, args)
+			}
+		}
+		if _, err := os.Stat(filepath.Join(workdir, fmt.Sprintf("plan-%s", app.Name))); !os.IsNotExist(err) {
+			t.Errorf("%s: plan file was not removed after apply", id)
+		}
+		if got := strings.Join(commands, ","); got != "init,plan,apply" {
+			t.Errorf("%s: expected init,plan,apply in its workdir, got %s", id, got)
+		}
+		maintf, err := os.ReadFile(filepath.Join(workdir, "main.tf"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf(`key = "k8sapp.%s.%s.json"`, app.Namespace, app.Name); string(maintf) != want {
+			t.Errorf("%s: rendered main.tf %q, want %q", id, maintf, want)
+		}
+	}
+}
+
+func TestLegacyStateAdopted(t *testing.T) {
+	baseDir, tfExe := newStubEnv(t)
+	backend := newFakeBackend(t)
+	backend.put("k8sapp.legacy.json", []byte("state"))
+	ctx := context.Background()
+	azapp := &k8sappv1alpha1.AzureApp{ObjectMeta: metav1.ObjectMeta{Name: "legacy", Namespace: "apps"}}
+	tfc, err := NewTerraformClient(ctx, tfExe, baseDir, azapp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tfc.PlanAzureResources(ctx, "plan-legacy"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := backend.blobs["k8sapp.legacy.json"]; ok {
+		t.Error("legacy state was not moved")
+	}
+	if string(backend.blobs["k8sapp.apps.legacy.json"]) != "state" {
+		t.Errorf("expected the legacy state under the namespaced key, got %q", backend.blobs["k8sapp.apps.legacy.json"])
+	}
+
+	// another app with the same name doesn't take a state that was already adopted
+	other := &k8sappv1alpha1.AzureApp{ObjectMeta: metav1.ObjectMeta{Name: "legacy", Namespace: "other"}}
+	tfc, err = NewTerraformClient(ctx, tfExe, baseDir, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tfc.PlanAzureResources(ctx, "plan-legacy"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := backend.blobs["k8sapp.other.legacy.json"]; ok || len(backend.blobs) != 1 {
+		t.Errorf("expected only the adopted state in the backend, got %d blobs", len(backend.blobs))
+	}
+}
+
+func TestApplyDiscardsStalePlan(t *testing.T) {
+	baseDir, tfExe := newStubEnv(t)
+	ctx := context.Background()
+	azapp := &k8sappv1alpha1.AzureApp{ObjectMeta: metav1.ObjectMeta{Name: "stale"}}
+	tfc, err := NewTerraformClient(ctx, tfExe, baseDir, azapp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tfc.PlanAzureResources(ctx, "plan-stale"); err != nil {
+		t.Fatal(err)
+	}
+	plan, err := os.Stat(filepath.Join(tfc.WorkingDir(), "plan-stale"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the spec changes after the plan was saved, within the same modification time
+	changed := azapp.DeepCopy()
+	changed.Spec.Identifier = "changed"
+	if _, err := NewTerraformClient(ctx, tfExe, baseDir, changed); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filepath.Join(tfc.WorkingDir(), "spec.auto.tfvars.json"), plan.ModTime(), plan.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tfc.ReconcileAzureResources(ctx, "plan-stale"); !errors.Is(err, ErrStalePlan) {
+		t.Fatalf("expected ErrStalePlan, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tfc.WorkingDir(), "plan-stale")); !os.IsNotExist(err) {
+		t.Error("stale plan file was not discarded")
+	}
+	calls, err := os.ReadFile(filepath.Join(tfc.WorkingDir(), "calls.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(calls), " apply ") {
+		t.Error("stale plan was applied")
+	}
+
+	// inputs that are only touched keep the plan
+	if _, err := tfc.PlanAzureResources(ctx, "plan-touched"); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(filepath.Join(tfc.WorkingDir(), "spec.auto.tfvars.json"), later, later); err != nil {
+		t.Fatal(err)
+	}
+	if err := tfc.ReconcileAzureResources(ctx, "plan-touched"); err != nil {
+		t.Fatalf("expected the plan of unchanged inputs to be applied, got %v", err)
+	}
+	for _, file := range []string{"plan-touched", "plan-touched.sha256"} {
+		if _, err := os.Stat(filepath.Join(tfc.WorkingDir(), file)); !os.IsNotExist(err) {
+			t.Errorf("%s was not removed after apply", file)
+		}
+	}
+}
+
+func TestInitOnlyRunsWhenMainChanges(t *testing.T) {
+	baseDir, tfExe := newStubEnv(t)
+	ctx := context.Background()
+	azapp := &k8sappv1alpha1.AzureApp{ObjectMeta: metav1.ObjectMeta{Name: "cached"}}
+	var hashes []string
+	for i := 0; i < 2; i++ {
+		tfc, err := NewTerraformClient(ctx, tfExe, baseDir, azapp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tfc.PlanAzureResources(ctx, "plan-cached"); err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, tfc.InputsHash())
+	}
+	// a spec change must change the inputs hash but doesn't need a new init
+	azapp.Spec.Identifier = "changed"
+	tfc, err := NewTerraformClient(ctx, tfExe, baseDir, azapp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tfc.PlanAzureResources(ctx, "plan-cached"); err != nil {
+		t.Fatal(err)
+	}
+	hashes = append(hashes, tfc.InputsHash())
+
+	if hashes[0] != hashes[1] {
+		t.Error("inputs hash changed for the same spec")
+	}
+	if hashes[1] == hashes[2] {
+		t.Error("inputs hash didn't change with the spec")
+	}
+	calls, err := os.ReadFile(filepath.Join(tfc.WorkingDir(), "calls.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inits := strings.Count(string(calls), " init "); inits != 1 {
+		t.Errorf("expected a single init, got %d", inits)
+	}
+}
+
+const stubPlanJSON = `{
+	"format_version": "1.1",
+	"terraform_version": "1.5.5",
+	"resource_changes": [
+		{"address": "module.azapp.azurerm_key_vault.this", "change": {"actions": ["delete", "create"]}},
+		{"address": "module.azapp.azuread_application.this", "change": {"actions": ["update"]}},
+		{"address": "module.azapp.azuread_service_principal_password.this", "change": {"actions": ["create"], "after": {"value": "super-secret"}, "after_sensitive": {"value": true}}},
+		{"address": "azurerm_mssql_database.db[0]", "change": {"actions": ["delete"]}},
+		{"address": "module.azapp.azurerm_role_assignment.current_client_2_kv", "change": {"actions": ["no-op"]}},
+		{"address": "data.http.current_ip", "change": {"actions": ["read"]}}
+	]
+}`
+
+func TestSummarizePlan(t *testing.T) {
+	baseDir, tfExe := newStubEnv(t)
+	planJSON := filepath.Join(t.TempDir(), "plan.json")
+	if err := os.WriteFile(planJSON, []byte(stubPlanJSON), 0666); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("STUB_PLAN_JSON", planJSON)
+	ctx := context.Background()
+	tfc, err := NewTerraformClient(ctx, tfExe, baseDir, &k8sappv1alpha1.AzureApp{ObjectMeta: metav1.ObjectMeta{Name: "summary"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	summary, err := tfc.SummarizePlan(ctx, "plan-summary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Add != 2 || summary.Change != 1 || summary.Destroy != 2 {
+		t.Errorf("expected 2 to add, 1 to change, 2 to destroy, got %d, %d, %d", summary.Add, summary.Change, summary.Destroy)
+	}
+	want := []k8sappv1alpha1.PlannedResource{
+		{Address: "module.azapp.azurerm_key_vault.this", Action: "replace"},
+		{Address: "module.azapp.azuread_application.this", Action: "update"},
+		{Address: "module.azapp.azuread_service_principal_password.this", Action: "create"},
+		{Address: "azurerm_mssql_database.db[0]", Action: "delete"},
+	}
+	if fmt.Sprint(summary.Resources) != fmt.Sprint(want) {
+		t.Errorf("expected resources %v, got %v", want, summary.Resources)
+	}
+	if out, _ := json.Marshal(summary); strings.Contains(string(out), "super-secret") {
+		t.Error("plan summary leaks a sensitive value")
+	}
+}
+
+func TestPlanHashFollowsChanges(t *testing.T) {
+	baseDir, tfExe := newStubEnv(t)
+	planJSON := filepath.Join(t.TempDir(), "plan.json")
+	t.Setenv("STUB_PLAN_JSON", planJSON)
+	ctx := context.Background()
+	tfc, err := NewTerraformClient(ctx, tfExe, baseDir, &k8sappv1alpha1.AzureApp{ObjectMeta: metav1.ObjectMeta{Name: "hash"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	planHash := func(plan string) string {
+		if err := os.WriteFile(planJSON, []byte(plan), 0666); err != nil {
+			t.Fatal(err)
+		}
+		summary, err := tfc.SummarizePlan(ctx, "plan-hash")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return summary.Hash
+	}
+
+	first, second := planHash(stubPlanJSON), planHash(stubPlanJSON)
+	if first == "" || first != second {
+		t.Errorf("expected the same hash for the same plan, got %q and %q", first, second)
+	}
+	// same addresses and actions but another value must need a new approval
+	if planHash(strings.Replace(stubPlanJSON, "super-secret", "other-secret", 1)) == first {
+		t.Error("hash didn't change with the planned values")
+	}
+	if strings.Contains(first, "super-secret") {
+		t.Error("plan hash leaks a sensitive value")
+	}
+}
+
+func TestTerraformCommandsAreTraced(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	baseDir, tfExe := newStubEnv(t)
+	ctx, root := tracing.Start(context.Background(), "Reconcile")
+	tfc, err := NewTerraformClient(ctx, tfExe, baseDir, &k8sappv1alpha1.AzureApp{ObjectMeta: metav1.ObjectMeta{Name: "traced", Namespace: "apps"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tfc.PlanAzureResources(ctx, "plan-traced"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tfc.ReconcileAzureResources(ctx, "plan-traced"); err != nil {
+		t.Fatal(err)
+	}
+	root.End()
+
+	var names []string
+	for _, span := range exporter.GetSpans() {
+		if span.Name == "Reconcile" {
+			continue
+		}
+		names = append(names, span.Name)
+		if span.Parent.SpanID() != root.SpanContext().SpanID() {
+			t.Errorf("%s span is not a child of the Reconcile span", span.Name)
+		}
+		attrs := map[string]string{}
+		for _, attr := range span.Attributes {
+			attrs[string(attr.Key)] = attr.Value.Emit()
+		}
+		if attrs["azureapp.name"] != "traced" || attrs["azureapp.namespace"] != "apps" {
+			t.Errorf("%s span doesn't identify the app: %v", span.Name, attrs)
+		}
+	}
+	if got := strings.Join(names, ","); got != "terraform init,terraform plan,terraform apply" {
+		t.Errorf("expected init, plan and apply spans, got %s", got)
+	}
+}
+
+// fakeBackend is an in memory terraform backend container, failDelete fails that many deletes
+type fakeBackend struct {
+	mu         sync.Mutex
+	blobs      map[string][]byte
+	etags      map[string]azcore.ETag
+	leased     map[string]bool
+	failDelete int
+	uploads    int
+}
+
+func newFakeBackend(t *testing.T) *fakeBackend {
+	backend := &fakeBackend{blobs: map[string][]byte{}, etags: map[string]azcore.ETag{}, leased: map[string]bool{}}
+	previous := newStateBlob
+	newStateBlob = func(key string) (stateBlob, error) { return &fakeBlob{backend: backend, key: key}, nil }
+	t.Cleanup(func() { newStateBlob = previous })
+	return backend
+}
+
+func (b *fakeBackend) put(key string, content []byte) {
+	b.blobs[key] = content
+	b.etags[key] = azcore.ETag(fmt.Sprintf("%q", fmt.Sprint(len(b.etags)+1)))
+}
+
+type fakeBlob struct {
+	backend *fakeBackend
+	key     string
+}
+
+var errBlobNotFound = &azcore.ResponseError{StatusCode: http.StatusNotFound}
+
+func (f *fakeBlob) DownloadStream(ctx context.Context, o *blob.DownloadStreamOptions) (blob.DownloadStreamResponse, error) {
+	f.backend.mu.Lock()
+	defer f.backend.mu.Unlock()
+	var resp blob.DownloadStreamResponse
+	content, ok := f.backend.blobs[f.key]
+	if !ok {
+		return resp, errBlobNotFound
+	}
+	etag := f.backend.etags[f.key]
+	resp.Body = io.NopCloser(bytes.NewReader(content))
+	resp.ETag = &etag
+	if f.backend.leased[f.key] {
+		locked := blob.LeaseStatusTypeLocked
+		resp.LeaseStatus = &locked
+	}
+	return resp, nil
+}
+
+func (f *fakeBlob) GetProperties(ctx context.Context, o *blob.GetPropertiesOptions) (blob.GetPropertiesResponse, error) {
+	f.backend.mu.Lock()
+	defer f.backend.mu.Unlock()
+	if _, ok := f.backend.blobs[f.key]; !ok {
+		return blob.GetPropertiesResponse{}, errBlobNotFound
+	}
+	return blob.GetPropertiesResponse{}, nil
+}
+
+func (f *fakeBlob) UploadBuffer(ctx context.Context, buffer []byte, o *blockblob.UploadBufferOptions) (blockblob.UploadBufferResponse, error) {
+	f.backend.mu.Lock()
+	defer f.backend.mu.Unlock()
+	f.backend.uploads++
+	f.backend.put(f.key, append([]byte(nil), buffer...))
+	return blockblob.UploadBufferResponse{}, nil
+}
+
+func (f *fakeBlob) Delete(ctx context.Context, o *blob.DeleteOptions) (blob.DeleteResponse, error) {
+	f.backend.mu.Lock()
+	defer f.backend.mu.Unlock()
+	if f.backend.failDelete > 0 {
+		f.backend.failDelete--
+		return blob.DeleteResponse{}, errors.New("delete failed")
+	}
+	if _, ok := f.backend.blobs[f.key]; !ok {
+		return blob.DeleteResponse{}, errBlobNotFound
+	}
+	if o == nil || o.AccessConditions == nil || o.AccessConditions.ModifiedAccessConditions == nil ||
+		o.AccessConditions.ModifiedAccessConditions.IfMatch == nil || *o.AccessConditions.ModifiedAccessConditions.IfMatch != f.backend.etags[f.key] {
+		return blob.DeleteResponse{}, &azcore.ResponseError{StatusCode: http.StatusPreconditionFailed}
+	}
+	delete(f.backend.blobs, f.key)
+	delete(f.backend.etags, f.key)
+	return blob.DeleteResponse{}, nil
+}
+
+func TestArchiveStateFile(t *testing.T) {
+	azapp := &k8sappv1alpha1.AzureApp{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "team-a", UID: "3f2a"}}
+	tombstone := "tombstones/3f2a.k8sapp.team-a.app.json"
+	baseDir, tfExe := newStubEnv(t)
+	tf, err := NewTerraformClient(context.Background(), tfExe, baseDir, azapp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("never applied", func(t *testing.T) {
+		backend := newFakeBackend(t)
+		key, err := tf.ArchiveStateFile(context.Background(), azapp)
+		if err != nil || key != "" {
+			t.Fatalf("got key %q, err %v, want no key and no error", key, err)
+		}
+		if backend.uploads != 0 {
+			t.Fatalf("uploaded %d tombstones for an app without state", backend.uploads)
+		}
+	})
+
+	t.Run("moves the state", func(t *testing.T) {
+		backend := newFakeBackend(t)
+		backend.put("k8sapp.team-a.app.json", []byte("state"))
+		key, err := tf.ArchiveStateFile(context.Background(), azapp)
+		if err != nil || key != tombstone {
+			t.Fatalf("got key %q, err %v, want %q", key, err, tombstone)
+		}
+		if _, ok := backend.blobs["k8sapp.team-a.app.json"]; ok {
+			t.Fatal("state was not deleted")
+		}
+		if string(backend.blobs[tombstone]) != "state" {
+			t.Fatalf("tombstone has %q, want the state", backend.blobs[tombstone])
+		}
+	})
+
+	t.Run("same name in another namespace", func(t *testing.T) {
+		backend := newFakeBackend(t)
+		backend.put("k8sapp.team-a.app.json", []byte("state"))
+		backend.put("k8sapp.team-b.app.json", []byte("other state"))
+		if _, err := tf.ArchiveStateFile(context.Background(), azapp); err != nil {
+			t.Fatal(err)
+		}
+		if string(backend.blobs["k8sapp.team-b.app.json"]) != "other state" {
+			t.Fatal("archiving team-a/app touched the state of team-b/app")
+		}
+		if string(backend.blobs[tombstone]) != "state" {
+			t.Fatalf("tombstone has %q, want the team-a state", backend.blobs[tombstone])
+		}
+	})
+
+	t.Run("retry after a failed delete", func(t *testing.T) {
+		backend := newFakeBackend(t)
+		backend.put("k8sapp.team-a.app.json", []byte("state"))
+		backend.failDelete = 1
+		if _, err := tf.ArchiveStateFile(context.Background(), azapp); err == nil {
+			t.Fatal("expected the failed delete to be returned")
+		}
+		key, err := tf.ArchiveStateFile(context.Background(), azapp)
+		if err != nil || key != tombstone {
+			t.Fatalf("got key %q, err %v, want %q", key, err, tombstone)
+		}
+		if len(backend.blobs) != 1 {
+			t.Fatalf("backend has %d blobs, want only the tombstone", len(backend.blobs))
+		}
+	})
+
+	t.Run("retry after the state was moved", func(t *testing.T) {
+		backend := newFakeBackend(t)
+		backend.put(tombstone, []byte("state"))
+		key, err := tf.ArchiveStateFile(context.Background(), azapp)
+		if err != nil || key != tombstone {
+			t.Fatalf("got key %q, err %v, want %q", key, err, tombstone)
+		}
+		if backend.uploads != 0 {
+			t.Fatalf("uploaded %d tombstones, want the existing one reused", backend.uploads)
+		}
+	})
+
+	t.Run("locked state", func(t *testing.T) {
+		backend := newFakeBackend(t)
+		backend.put("k8sapp.team-a.app.json", []byte("state"))
+		backend.leased["k8sapp.team-a.app.json"] = true
+		if _, err := tf.ArchiveStateFile(context.Background(), azapp); err == nil {
+			t.Fatal("expected a locked state to fail the archive")
+		}
+		if backend.uploads != 0 {
+			t.Fatalf("uploaded %d tombstones of a locked state", backend.uploads)
+		}
+	})
+}
@@ -0,0 +1,142 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	k8sappv1alpha1 "github.com/rdalbuquerque/azure-operator/operator/api/v1alpha1"
+	"github.com/rdalbuquerque/azure-operator/operator/controllers/internal/az"
+	"github.com/rdalbuquerque/azure-operator/operator/controllers/internal/dependencies"
+	"github.com/rdalbuquerque/azure-operator/operator/controllers/internal/kubeobjects"
+)
+
+// KeyVaultSecretWatcher reads the spec.keyVaultSecrets of every provisioned app from its key vault on a schedule.
+// New secret versions are synced into the app key vault secrets secret and a reconcile of the app is queued, which
+// rolls the deployment through the same path as any other change, behind the migration Job, and records the synced
+// versions in status. Terraform isn't run again while its inputs are unchanged.
+type KeyVaultSecretWatcher struct {
+	Reconciler *AzureAppReconciler
+	// Interval between two refreshes of the same app
+	Interval time.Duration
+	// GetSecrets reads the app key vault secrets, dependencies.GetKeyVaultSecrets when nil
+	GetSecrets func(ctx context.Context, azapp *k8sappv1alpha1.AzureApp) ([]az.Secret, error)
+
+	tracker checkTracker
+}
+
+// NeedLeaderElection makes only the leader manager refresh secrets
+func (w *KeyVaultSecretWatcher) NeedLeaderElection() bool {
+	return true
+}
+
+// Start refreshes the due apps every tick until ctx is done
+func (w *KeyVaultSecretWatcher) Start(ctx context.Context) error {
+	logr := log.Log.WithName("keyvault-secret-watcher")
+	ctx = log.IntoContext(ctx, logr)
+	ticker := time.NewTicker(watcherTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := w.refreshDue(ctx, time.Now()); err != nil {
+				logr.Error(err, "unable to refresh app key vault secrets")
+			}
+		}
+	}
+}
+
+// refreshDue refreshes the key vault secrets of every watched app whose next refresh is due
+func (w *KeyVaultSecretWatcher) refreshDue(ctx context.Context, now time.Time) error {
+	logr := logr.FromContextOrDiscard(ctx)
+	azapps := &k8sappv1alpha1.AzureAppList{}
+	if err := w.Reconciler.List(ctx, azapps); err != nil {
+		return err
+	}
+	var watched []types.NamespacedName
+	for i := range azapps.Items {
+		azapp := &azapps.Items[i]
+		if !keyVaultSecretsWatched(azapp) {
+			continue
+		}
+		key := client.ObjectKeyFromObject(azapp)
+		watched = append(watched, key)
+		if !w.tracker.due(key, now, w.Interval) {
+			continue
+		}
+		if err := w.refresh(ctx, azapp); err != nil {
+			logr.Error(err, "unable to refresh key vault secrets", "app", azapp.Name, "namespace", azapp.Namespace)
+			w.Reconciler.Recorder.Event(azapp, corev1.EventTypeWarning, "KeyVaultSecretsRefreshFailed", err.Error())
+		}
+	}
+	w.tracker.retain(watched)
+	return nil
+}
+
+// keyVaultSecretsWatched tells if the app key vault secrets are synced for its current spec and the watcher
+// should keep them up to date, apps still being reconciled, suspended or being deleted are left to Reconcile
+func keyVaultSecretsWatched(azapp *k8sappv1alpha1.AzureApp) bool {
+	return len(azapp.Spec.KeyVaultSecrets) > 0 && azapp.DeletionTimestamp.IsZero() && !suspended(azapp) &&
+		azapp.Status.ObservedGeneration == azapp.Generation &&
+		meta.IsStatusConditionTrue(azapp.Status.Conditions, k8sappv1alpha1.ConditionKubernetesObjectsReady)
+}
+
+// refresh syncs the key vault secrets into the app secret when a version changed and queues a reconcile, which
+// restarts the deployment pods with the new values
+func (w *KeyVaultSecretWatcher) refresh(ctx context.Context, azapp *k8sappv1alpha1.AzureApp) error {
+	getSecrets := w.GetSecrets
+	if getSecrets == nil {
+		getSecrets = dependencies.GetKeyVaultSecrets
+	}
+	kvSecrets, err := getSecrets(ctx, azapp)
+	if err != nil {
+		return err
+	}
+	status := keyVaultSecretsStatus(azapp, kvSecrets)
+	if equality.Semantic.DeepEqual(status, azapp.Status.KeyVaultSecrets) {
+		return nil
+	}
+
+	kubeclient := kubeobjects.NewKubeClient(ctx, w.Reconciler.Client, applyOpts)
+	secret, err := w.Reconciler.desiredKeyVaultSecret(kvSecrets, azapp)
+	if err != nil {
+		return err
+	}
+	if err := kubeclient.ApplyAll([]client.Object{&secret}); err != nil {
+		return err
+	}
+	w.Reconciler.Recorder.Event(azapp, corev1.EventTypeNormal, "KeyVaultSecretsUpdated",
+		fmt.Sprintf("Synced %s into secret %s, the deployment restarts on the next reconcile", changedKeyVaultSecrets(azapp.Status.KeyVaultSecrets, status), secret.Name))
+	// the status is only updated by the reconcile, once the deployment rolled out with the new versions
+	w.Reconciler.requestReconcile(ctx, azapp)
+	return nil
+}
+
+// changedKeyVaultSecrets lists the secrets of current whose version isn't in synced, for the event message
+func changedKeyVaultSecrets(synced, current []k8sappv1alpha1.KeyVaultSecretStatus) string {
+	versions := make(map[string]bool, len(synced))
+	for _, s := range synced {
+		versions[s.Name+"/"+s.Version] = true
+	}
+	var changed []string
+	for _, s := range current {
+		if !versions[s.Name+"/"+s.Version] {
+			changed = append(changed, fmt.Sprintf("%s version %s", s.Name, s.Version))
+		}
+	}
+	if len(changed) == 0 {
+		return "key vault secrets"
+	}
+	return strings.Join(changed, ", ")
+}
@@ -0,0 +1,116 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	k8sappv1alpha1 "github.com/rdalbuquerque/azure-operator/operator/api/v1alpha1"
+	"github.com/rdalbuquerque/azure-operator/operator/controllers/internal/az"
+)
+
+func TestKeyVaultSecretsWatched(t *testing.T) {
+	provisioned := func() *k8sappv1alpha1.AzureApp {
+		return &k8sappv1alpha1.AzureApp{
+			ObjectMeta: metav1.ObjectMeta{Name: "app1", Generation: 2},
+			Spec: k8sappv1alpha1.AzureAppSpec{
+				KeyVaultSecrets: []k8sappv1alpha1.KeyVaultSecret{{Name: "db-connection", EnvVar: "DB_CONNECTION"}},
+			},
+			Status: k8sappv1alpha1.AzureAppStatus{
+				ObservedGeneration: 2,
+				Conditions: []metav1.Condition{
+					{Type: k8sappv1alpha1.ConditionKubernetesObjectsReady, Status: metav1.ConditionTrue, Reason: "Applied"},
+				},
+			},
+		}
+	}
+	if !keyVaultSecretsWatched(provisioned()) {
+		t.Error("provisioned app with key vault secrets should be watched")
+	}
+	tests := map[string]func(*k8sappv1alpha1.AzureApp){
+		"without key vault secrets": func(a *k8sappv1alpha1.AzureApp) { a.Spec.KeyVaultSecrets = nil },
+		"changed spec":              func(a *k8sappv1alpha1.AzureApp) { a.Generation = 3 },
+		"suspended":                 func(a *k8sappv1alpha1.AzureApp) { a.Spec.Suspend = true },
+		"not applied":               func(a *k8sappv1alpha1.AzureApp) { a.Status.Conditions[0].Status = metav1.ConditionFalse },
+		"deleting": func(a *k8sappv1alpha1.AzureApp) {
+			now := metav1.Now()
+			a.DeletionTimestamp = &now
+		},
+	}
+	for name, mutate := range tests {
+		azapp := provisioned()
+		mutate(azapp)
+		if keyVaultSecretsWatched(azapp) {
+			t.Errorf("app %s shouldn't be watched", name)
+		}
+	}
+}
+
+func TestChangedKeyVaultSecrets(t *testing.T) {
+	synced := []k8sappv1alpha1.KeyVaultSecretStatus{{Name: "db-connection", Version: "v1"}, {Name: "api-key", Version: "v7"}}
+	current := []k8sappv1alpha1.KeyVaultSecretStatus{{Name: "db-connection", Version: "v1"}, {Name: "api-key", Version: "v8"}}
+	if changed := changedKeyVaultSecrets(synced, current); changed != "api-key version v8" {
+		t.Errorf("expected only api-key to have changed, got %q", changed)
+	}
+	if changed := changedKeyVaultSecrets(nil, synced); changed != "db-connection version v1, api-key version v7" {
+		t.Errorf("expected every secret to be new, got %q", changed)
+	}
+}
+
+// applyRecorder records the objects applied through it, any other call fails the test by panicking
+type applyRecorder struct {
+	client.Client
+	applied []client.Object
+}
+
+func (c *applyRecorder) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	c.applied = append(c.applied, obj)
+	return nil
+}
+
+func TestKeyVaultSecretRefreshQueuesReconcile(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := k8sappv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	kubeClient := &applyRecorder{}
+	r := &AzureAppReconciler{Client: kubeClient, Scheme: scheme, Recorder: record.NewFakeRecorder(10), reconcileRequests: make(chan event.GenericEvent, 1)}
+	w := &KeyVaultSecretWatcher{
+		Reconciler: r,
+		GetSecrets: func(ctx context.Context, azapp *k8sappv1alpha1.AzureApp) ([]az.Secret, error) {
+			return []az.Secret{{Version: "v2", Value: "new"}}, nil
+		},
+	}
+	azapp := &k8sappv1alpha1.AzureApp{
+		ObjectMeta: metav1.ObjectMeta{Name: "app1", Namespace: "default"},
+		Spec: k8sappv1alpha1.AzureAppSpec{
+			Identifier:      "apprda001",
+			KeyVaultSecrets: []k8sappv1alpha1.KeyVaultSecret{{Name: "db-connection", EnvVar: "DB_CONNECTION"}},
+		},
+		Status: k8sappv1alpha1.AzureAppStatus{KeyVaultSecrets: []k8sappv1alpha1.KeyVaultSecretStatus{{Name: "db-connection", Version: "v1"}}},
+	}
+
+	if err := w.refresh(context.Background(), azapp); err != nil {
+		t.Fatal(err)
+	}
+	if len(kubeClient.applied) != 1 {
+		t.Fatalf("expected only the secret to be applied, got %d objects", len(kubeClient.applied))
+	}
+	if _, ok := kubeClient.applied[0].(*corev1.Secret); !ok {
+		t.Fatalf("expected the key vault secrets secret to be applied, got %T", kubeClient.applied[0])
+	}
+	select {
+	case request := <-r.reconcileRequests:
+		if request.Object.GetName() != "app1" {
+			t.Errorf("expected a reconcile of app1, got %s", request.Object.GetName())
+		}
+	default:
+		t.Error("expected a reconcile to roll out the deployment")
+	}
+}
@@ -0,0 +1,103 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	k8sappv1alpha1 "github.com/rdalbuquerque/azure-operator/operator/api/v1alpha1"
+	"github.com/rdalbuquerque/azure-operator/operator/controllers/internal/dependencies"
+	"github.com/rdalbuquerque/azure-operator/operator/controllers/internal/metrics"
+)
+
+// OrphanedUserScanner looks for database users left behind by deleted apps in the app databases on a schedule.
+// The operator names users <identifier>-app, a FROM EXTERNAL PROVIDER user with that suffix whose identifier
+// matches no AzureApp is reported with a Warning event on the app owning the database and the
+// azureapp_orphaned_database_users metric. Reported users are never dropped by the scan.
+type OrphanedUserScanner struct {
+	Reconciler *AzureAppReconciler
+	// Interval between two scans
+	Interval time.Duration
+	// ListUsers lists the external users of the app database, dependencies.ListDatabaseUsers when nil
+	ListUsers func(ctx context.Context, azapp *k8sappv1alpha1.AzureApp) ([]string, error)
+}
+
+// NeedLeaderElection makes only the leader manager scan databases
+func (s *OrphanedUserScanner) NeedLeaderElection() bool {
+	return true
+}
+
+// Start scans right away and then every interval until ctx is done
+func (s *OrphanedUserScanner) Start(ctx context.Context) error {
+	logr := log.Log.WithName("orphaned-user-scanner")
+	ctx = log.IntoContext(ctx, logr)
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+	for {
+		if err := s.scan(ctx); err != nil {
+			logr.Error(err, "unable to scan app databases for orphaned users")
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// scan reports the orphaned users of every app database it can reach
+func (s *OrphanedUserScanner) scan(ctx context.Context) error {
+	logr := logr.FromContextOrDiscard(ctx)
+	listUsers := s.ListUsers
+	if listUsers == nil {
+		listUsers = dependencies.ListDatabaseUsers
+	}
+	azapps := &k8sappv1alpha1.AzureAppList{}
+	if err := s.Reconciler.List(ctx, azapps); err != nil {
+		return err
+	}
+	// apps being deleted still own their user until the finalizer drops it
+	identifiers := make(map[string]bool, len(azapps.Items))
+	for _, azapp := range azapps.Items {
+		identifiers[azapp.Spec.Identifier] = true
+	}
+	counts := make(map[string]int)
+	for i := range azapps.Items {
+		azapp := &azapps.Items[i]
+		if !azapp.Spec.Database.Enabled || !azapp.DeletionTimestamp.IsZero() {
+			continue
+		}
+		users, err := listUsers(ctx, azapp)
+		if err != nil {
+			logr.Error(err, "unable to list database users", "app", azapp.Name, "namespace", azapp.Namespace)
+			continue
+		}
+		database := dependencies.DatabaseName(azapp)
+		orphaned := orphanedUsers(users, identifiers)
+		counts[database] = len(orphaned)
+		for _, user := range orphaned {
+			logr.Info(fmt.Sprintf("Database user %s in database %s has no matching AzureApp", user, database))
+			s.Reconciler.Recorder.Event(azapp, corev1.EventTypeWarning, "OrphanedDatabaseUser",
+				fmt.Sprintf("Database user %s in database %s has no matching AzureApp, drop it once it's no longer needed", user, database))
+		}
+	}
+	metrics.SetOrphanedDatabaseUsers(counts)
+	return nil
+}
+
+// orphanedUsers lists the users named like the operator names app users whose identifier isn't in identifiers,
+// other external users like administrators or groups aren't the operator's
+func orphanedUsers(users []string, identifiers map[string]bool) []string {
+	var orphaned []string
+	for _, user := range users {
+		if strings.HasSuffix(user, "-app") && !identifiers[strings.TrimSuffix(user, "-app")] {
+			orphaned = append(orphaned, user)
+		}
+	}
+	return orphaned
+}
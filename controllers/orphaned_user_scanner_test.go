@@ -0,0 +1,77 @@
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	k8sappv1alpha1 "github.com/rdalbuquerque/azure-operator/operator/api/v1alpha1"
+)
+
+// appLister serves a fixed AzureApp list
+type appLister struct {
+	client.Client
+	azapps []k8sappv1alpha1.AzureApp
+}
+
+func (l appLister) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	list.(*k8sappv1alpha1.AzureAppList).Items = l.azapps
+	return nil
+}
+
+func TestOrphanedUsers(t *testing.T) {
+	identifiers := map[string]bool{"apprda001": true}
+	users := []string{"apprda001-app", "apprda002-app", "dba-group", "someone@contoso.com"}
+	if orphaned := orphanedUsers(users, identifiers); !reflect.DeepEqual(orphaned, []string{"apprda002-app"}) {
+		t.Errorf("expected only apprda002-app to be orphaned, got %v", orphaned)
+	}
+}
+
+func TestOrphanedUserScannerReportsUsers(t *testing.T) {
+	withDatabase := func(name, identifier string) k8sappv1alpha1.AzureApp {
+		return k8sappv1alpha1.AzureApp{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec:       k8sappv1alpha1.AzureAppSpec{Identifier: identifier, Database: k8sappv1alpha1.DatabaseSpec{Enabled: true}},
+		}
+	}
+	now := metav1.Now()
+	deleting := withDatabase("app3", "apprda003")
+	deleting.DeletionTimestamp = &now
+	recorder := record.NewFakeRecorder(10)
+	var scanned []string
+	scanner := &OrphanedUserScanner{
+		Reconciler: &AzureAppReconciler{
+			Client:   appLister{azapps: []k8sappv1alpha1.AzureApp{withDatabase("app1", "apprda001"), withDatabase("app2", "apprda002"), deleting}},
+			Recorder: recorder,
+		},
+		ListUsers: func(ctx context.Context, azapp *k8sappv1alpha1.AzureApp) ([]string, error) {
+			scanned = append(scanned, azapp.Name)
+			// the user of the app being deleted isn't dropped yet, it must not be reported
+			return []string{azapp.Spec.Identifier + "-app", "apprda003-app", "legacy-app"}, nil
+		},
+	}
+	if err := scanner.scan(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(scanned, []string{"app1", "app2"}) {
+		t.Errorf("expected the databases of app1 and app2 to be scanned, got %v", scanned)
+	}
+	close(recorder.Events)
+	var events []string
+	for event := range recorder.Events {
+		events = append(events, event)
+	}
+	if len(events) != 2 {
+		t.Fatalf("expected legacy-app to be reported once per database, got %v", events)
+	}
+	for _, event := range events {
+		if !strings.HasPrefix(event, "Warning OrphanedDatabaseUser Database user legacy-app in database apprda00") {
+			t.Errorf("unexpected event %q", event)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+// Package tracing sets up OpenTelemetry tracing for the operator. Spans are always created through the global
+// tracer provider, which only records them once Setup installed an exporter, so tracing is off by default.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/rdalbuquerque/azure-operator/operator"
+
+// Setup exports spans over OTLP/HTTP to endpoint, a host:port, and propagates trace context with the W3C
+// traceparent header. The returned function flushes the pending spans and must be called before exiting.
+func Setup(ctx context.Context, endpoint string, insecure bool) (func(context.Context) error, error) {
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(endpoint)}
+	if insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String("azureapp-operator"))),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return tp.Shutdown, nil
+}
+
+// Start starts a span named name as a child of the span in ctx, if any
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End marks span as failed when err isn't nil and ends it
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// ClientOptions returns azcore client options that trace every request made by an Azure SDK client
+func ClientOptions() azcore.ClientOptions {
+	return azcore.ClientOptions{PerRetryPolicies: []policy.Policy{azcorePolicy{}}}
+}
+
+// azcorePolicy wraps each Azure SDK request attempt in a client span and sends its trace context along
+type azcorePolicy struct{}
+
+func (azcorePolicy) Do(req *policy.Request) (*http.Response, error) {
+	raw := req.Raw()
+	// the query is left out, it may hold a SAS token
+	url := fmt.Sprintf("%s://%s%s", raw.URL.Scheme, raw.URL.Host, raw.URL.Path)
+	ctx, span := otel.Tracer(instrumentationName).Start(raw.Context(), fmt.Sprintf("HTTP %s", raw.Method),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.HTTPMethodKey.String(raw.Method), semconv.HTTPURLKey.String(url)),
+	)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(raw.Header))
+	resp, err := req.Next()
+	if resp != nil {
+		span.SetAttributes(semconv.HTTPStatusCodeKey.Int(resp.StatusCode))
+		if resp.StatusCode >= http.StatusBadRequest {
+			span.SetStatus(codes.Error, resp.Status)
+		}
+	}
+	End(span, err)
+	return resp, err
+}
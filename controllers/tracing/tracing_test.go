@@ -0,0 +1,67 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestAzcorePolicyPropagatesTraceContext(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	var traceparent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	options := ClientOptions()
+	pipeline := runtime.NewPipeline("tracing", "v0", runtime.PipelineOptions{}, &policy.ClientOptions{
+		PerRetryPolicies: options.PerRetryPolicies,
+		Retry:            policy.RetryOptions{MaxRetries: -1},
+	})
+	ctx, parent := Start(context.Background(), "Reconcile")
+	req, err := runtime.NewRequest(ctx, http.MethodGet, server.URL+"/certificates/tls?sig=secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pipeline.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	parent.End()
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("expected the request and Reconcile spans, got %d", len(spans))
+	}
+	request := spans[0]
+	if request.Name != "HTTP GET" || request.SpanKind != trace.SpanKindClient {
+		t.Errorf("unexpected request span %s of kind %s", request.Name, request.SpanKind)
+	}
+	if request.Parent.SpanID() != parent.SpanContext().SpanID() {
+		t.Error("request span is not a child of the Reconcile span")
+	}
+	if want := "00-" + request.SpanContext.TraceID().String() + "-" + request.SpanContext.SpanID().String() + "-01"; traceparent != want {
+		t.Errorf("expected traceparent %s, got %q", want, traceparent)
+	}
+	for _, attr := range request.Attributes {
+		if attr.Key == "http.url" && attr.Value.AsString() != server.URL+"/certificates/tls" {
+			t.Errorf("request url attribute should leave the query out, got %s", attr.Value.AsString())
+		}
+		if attr.Key == "http.status_code" && attr.Value.AsInt64() != http.StatusNotFound {
+			t.Errorf("expected status code attribute 404, got %d", attr.Value.AsInt64())
+		}
+	}
+}
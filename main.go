@@ -17,8 +17,10 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"flag"
 	"os"
+	"text/template"
 	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
@@ -37,8 +39,10 @@ import (
 	_ "net/http/pprof"
 
 	k8sappv0alpha1 "github.com/rdalbuquerque/azure-operator/operator/api/v0alpha1"
+	k8sappv1alpha1 "github.com/rdalbuquerque/azure-operator/operator/api/v1alpha1"
 	"github.com/rdalbuquerque/azure-operator/operator/controllers"
 	"github.com/rdalbuquerque/azure-operator/operator/controllers/config"
+	"github.com/rdalbuquerque/azure-operator/operator/controllers/tracing"
 	//+kubebuilder:scaffold:imports
 )
 
@@ -51,6 +55,7 @@ func init() {
 	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
 
 	utilruntime.Must(k8sappv0alpha1.AddToScheme(scheme))
+	utilruntime.Must(k8sappv1alpha1.AddToScheme(scheme))
 	//+kubebuilder:scaffold:scheme
 }
 
@@ -62,11 +67,16 @@ func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
+	var otlpEndpoint string
+	var otlpInsecure bool
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.StringVar(&otlpEndpoint, "otlp-endpoint", "",
+		"The host:port of an OTLP/HTTP collector to export traces to. Tracing is disabled when empty.")
+	flag.BoolVar(&otlpInsecure, "otlp-insecure", false, "Export traces over plain HTTP instead of HTTPS.")
 	opts := zap.Options{
 		Development: true,
 		TimeEncoder: zapcore.ISO8601TimeEncoder,
@@ -76,6 +86,17 @@ func main() {
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
+	shutdownTracing := func(context.Context) error { return nil }
+	if otlpEndpoint != "" {
+		shutdown, err := tracing.Setup(context.Background(), otlpEndpoint, otlpInsecure)
+		if err != nil {
+			setupLog.Error(err, "unable to set up tracing")
+			os.Exit(1)
+		}
+		shutdownTracing = shutdown
+		setupLog.Info("exporting traces", "endpoint", otlpEndpoint)
+	}
+
 	gracefulShutdownTimeout := new(time.Duration)
 	*gracefulShutdownTimeout = time.Duration(5 * time.Minute)
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
@@ -104,13 +125,48 @@ func main() {
 		os.Exit(1)
 	}
 
-	if err = (&controllers.AzureAppReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
-	}).SetupWithManager(mgr); err != nil {
+	reconciler := &controllers.AzureAppReconciler{
+		Client:   mgr.GetClient(),
+		Scheme:   mgr.GetScheme(),
+		Recorder: mgr.GetEventRecorderFor("azureapp-controller"),
+	}
+	if err = reconciler.SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "AzureApp")
 		os.Exit(1)
 	}
+	if err = mgr.Add(&controllers.CertificateWatcher{
+		Reconciler:    reconciler,
+		Interval:      config.Config.CertificateCheckInterval,
+		ExpiryWarning: config.Config.CertificateExpiryWarning,
+	}); err != nil {
+		setupLog.Error(err, "unable to create certificate watcher")
+		os.Exit(1)
+	}
+	if err = mgr.Add(&controllers.KeyVaultSecretWatcher{
+		Reconciler: reconciler,
+		Interval:   config.Config.KeyVaultSecretRefreshInterval,
+	}); err != nil {
+		setupLog.Error(err, "unable to create key vault secret watcher")
+		os.Exit(1)
+	}
+	if err = mgr.Add(&controllers.OrphanedUserScanner{
+		Reconciler: reconciler,
+		Interval:   config.Config.OrphanedUserScanInterval,
+	}); err != nil {
+		setupLog.Error(err, "unable to create orphaned database user scanner")
+		os.Exit(1)
+	}
+	if os.Getenv("ENABLE_WEBHOOKS") != "false" {
+		defaulter := &k8sappv1alpha1.AzureAppDefaulter{}
+		if config.Config.URLTemplate != "" {
+			defaulter.URLTemplate = template.Must(template.New("url").Option("missingkey=error").Parse(config.Config.URLTemplate))
+		}
+		// the conversion webhook for v0alpha1 is registered along with the hub version webhooks
+		if err = (&k8sappv1alpha1.AzureApp{}).SetupWebhookWithManager(mgr, defaulter); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "AzureApp")
+			os.Exit(1)
+		}
+	}
 	//+kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
@@ -125,6 +181,12 @@ func main() {
 	setupLog.Info("starting manager")
 	mgrCtx := ctrl.SetupSignalHandler()
 	err = mgr.Start(mgrCtx)
+	// flush the spans of the last reconciles before exiting
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		setupLog.Error(err, "unable to flush traces")
+	}
+	cancel()
 	if err != nil {
 		setupLog.Error(err, "problem running manager")
 		os.Exit(1)